@@ -0,0 +1,161 @@
+// clip.go -- clipping lines and polygons to a rectangle
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Rectangles for clipping are [4]float64: left, top, right, bottom, as made by bounds().
+
+// The rectangle covered by the image
+func imageBox(width, height int) [4]float64 {
+	return [4]float64{0, 0, float64(width), float64(height)}
+}
+
+// The rectangle, in pixels, that contours are clipped to with --clip: the
+// image, less half the line width so that lines along the edge stay on the
+// image, and less --clip-inset.  scale is the size of a pixel in mm.
+func clipBox(opts OptsT, scale float64) [4]float64 {
+	inset := (opts.linewidth/2 + opts.clipInset) / scale
+	return [4]float64{inset, inset, float64(opts.width) - inset, float64(opts.height) - inset}
+}
+
+// An error if --clip-inset (with half the line width) leaves nothing of the
+// image inside the clipping rectangle, once the image's size on the paper is known.
+func checkClipBox(opts OptsT) error {
+	if !opts.clip {
+		return nil
+	}
+	box := clipBox(opts, newPlacement(opts).scale)
+	if box[2] <= box[0] || box[3] <= box[1] {
+		return fmt.Errorf("clip inset %gmm leaves nothing of the image to plot", opts.clipInset)
+	}
+	return nil
+}
+
+// With --clip-geometry or --clip-inset, the background's fill is cut down
+// to the clipping rectangle too, so that it stays inside the frame.
+func clipBackground(opts OptsT) bool {
+	return opts.clip && (opts.clipGeometry || opts.clipInset != 0)
+}
+
+func inBox(p Point64T, box [4]float64) bool {
+	return p.x >= box[0] && p.y >= box[1] && p.x <= box[2] && p.y <= box[3]
+}
+
+// Make sure that a point that's been clipped is exactly on or in the rectangle,
+// whatever rounding errors there have been.
+func clampToBox(p Point64T, box [4]float64) Point64T {
+	return Point64T{math.Max(box[0], math.Min(box[2], p.x)), math.Max(box[1], math.Min(box[3], p.y))}
+}
+
+// Clip the line from a to b to the rectangle (Liang-Barsky).  Returns the
+// part that's inside, and false if none of it is.
+func clipSegment(a, b Point64T, box [4]float64) (Point64T, Point64T, bool) {
+	dx := b.x - a.x
+	dy := b.y - a.y
+	t0, t1 := 0.0, 1.0
+	// For each edge: how fast the line heads out through it, and how far inside a is
+	for _, edge := range [4][2]float64{{-dx, a.x - box[0]}, {dx, box[2] - a.x}, {-dy, a.y - box[1]}, {dy, box[3] - a.y}} {
+		p, q := edge[0], edge[1]
+		if p == 0 {
+			if q < 0 {
+				return a, b, false // parallel to the edge, and outside it
+			}
+			continue
+		}
+		t := q / p
+		if p < 0 {
+			t0 = math.Max(t0, t) // coming in
+		} else {
+			t1 = math.Min(t1, t) // going out
+		}
+		if t0 > t1 {
+			return a, b, false
+		}
+	}
+	clipped0, clipped1 := a, b
+	if t0 > 0 {
+		clipped0 = clampToBox(Point64T{a.x + t0*dx, a.y + t0*dy}, box)
+	}
+	if t1 < 1 {
+		clipped1 = clampToBox(Point64T{a.x + t1*dx, a.y + t1*dy}, box)
+	}
+	return clipped0, clipped1, true
+}
+
+// Clip a closed polygon to the rectangle (Sutherland-Hodgman), clipping
+// against each edge in turn.  Where the polygon goes outside, it's replaced
+// by a path along the edge, and corners are put in where it goes round them.
+// Returns nil if none of the polygon is inside.
+func clipPolygon(poly ContourT, box [4]float64) ContourT {
+	if len(poly) > 1 && poly[0].Equal(poly[len(poly)-1]) {
+		poly = poly[:len(poly)-1]
+	}
+	// whether a point is inside each edge, and where a line crosses it
+	edges := []struct {
+		inside func(p Point64T) bool
+		cross  func(a, b Point64T) Point64T
+	}{
+		{func(p Point64T) bool { return p.x >= box[0] }, func(a, b Point64T) Point64T { return crossX(a, b, box[0]) }},
+		{func(p Point64T) bool { return p.x <= box[2] }, func(a, b Point64T) Point64T { return crossX(a, b, box[2]) }},
+		{func(p Point64T) bool { return p.y >= box[1] }, func(a, b Point64T) Point64T { return crossY(a, b, box[1]) }},
+		{func(p Point64T) bool { return p.y <= box[3] }, func(a, b Point64T) Point64T { return crossY(a, b, box[3]) }},
+	}
+	out := poly
+	for _, edge := range edges {
+		if len(out) == 0 {
+			return nil
+		}
+		in := out
+		out = make(ContourT, 0, len(in)+4)
+		prev := in[len(in)-1]
+		for _, p := range in {
+			switch {
+			case edge.inside(p) && edge.inside(prev):
+				out = append(out, p)
+			case edge.inside(p):
+				out = append(out, edge.cross(prev, p), p)
+			case edge.inside(prev):
+				out = append(out, edge.cross(prev, p))
+			}
+			prev = p
+		}
+	}
+	if len(out) < 3 {
+		return nil
+	}
+	for i := range out {
+		out[i] = clampToBox(out[i], box)
+	}
+	// close it again
+	return append(out, out[0])
+}
+
+// Where the line through a and b crosses the vertical line at x
+func crossX(a, b Point64T, x float64) Point64T {
+	return Point64T{x, a.y + (b.y-a.y)*(x-a.x)/(b.x-a.x)}
+}
+
+// Where the line through a and b crosses the horizontal line at y
+func crossY(a, b Point64T, y float64) Point64T {
+	return Point64T{a.x + (b.x-a.x)*(y-a.y)/(b.y-a.y), y}
+}
@@ -0,0 +1,174 @@
+// dxf.go -- DXF output for laser cutters and CAD
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DXF (R12, ASCII) has its origin at the bottom left of the paper, with Y
+// going up the page, in mm.  Each threshold has its own layer, with the
+// contours as POLYLINEs: closed where the contour is closed, and open
+// where it's been broken at the edge of the image.
+type DXFFile struct {
+	file       *os.File
+	filename   string
+	placement  PlacementT
+	paper      RectangleT
+	layerNames []string // indexed like SVGfile.thresholds
+}
+
+func (dxf *DXFFile) write(s string) {
+	fmt.Fprint(dxf.file, s)
+}
+
+// Write a group: a code, and its value on the next line
+func (dxf *DXFFile) group(code int, value string) {
+	dxf.write(fmt.Sprintf("%3d\n%s\n", code, value))
+}
+
+func (dxf *DXFFile) coord(code int, v float64) {
+	dxf.group(code, fmt.Sprintf("%.4f", v))
+}
+
+func (dxf *DXFFile) writeComment(s string) {
+	dxf.group(999, s)
+}
+
+func (dxf *DXFFile) open(filename string) {
+	dxf.filename = filename
+	dxf.file = createFile(filename)
+}
+
+// Layer names can only have letters, digits, '_', '-', and '$'.
+func dxfLayerName(threshold float64, label string) string {
+	return strings.ToUpper(label) + "_" + strings.ReplaceAll(fmt.Sprintf("%g", threshold), ".", "_")
+}
+
+// Draw a path, given in mm on the paper.
+func (dxf *DXFFile) drawPath(path ContourT, layerName string) {
+	if len(path) < 2 {
+		return
+	}
+	closed := path[0].Equal(path[len(path)-1])
+	if closed {
+		// the closing point is implied
+		path = path[:len(path)-1]
+	}
+	dxf.group(0, "POLYLINE")
+	dxf.group(8, layerName)
+	dxf.group(66, "1") // vertices follow
+	dxf.coord(10, 0)
+	dxf.coord(20, 0)
+	dxf.coord(30, 0)
+	if closed {
+		dxf.group(70, "1")
+	} else {
+		dxf.group(70, "0")
+	}
+	for _, p := range path {
+		dxf.group(0, "VERTEX")
+		dxf.group(8, layerName)
+		dxf.coord(10, p.x)
+		dxf.coord(20, dxf.paper.height-p.y)
+		dxf.coord(30, 0)
+	}
+	dxf.group(0, "SEQEND")
+	dxf.group(8, layerName)
+}
+
+func (dxf *DXFFile) start(opts OptsT) (scale float64) {
+	dxf.placement = newPlacement(opts)
+	dxf.paper = opts.paperSize
+	dxf.layerNames = make([]string, len(opts.thresholds)+1)
+	dxf.layerNames[0] = "FRAME"
+	for i, style := range layerStyles(opts)[1:] {
+		label := "contour"
+		if style.index {
+			label = "index"
+		}
+		dxf.layerNames[i+1] = dxfLayerName(opts.thresholds[i], label)
+	}
+
+	dxf.group(0, "SECTION")
+	dxf.group(2, "HEADER")
+	dxf.group(9, "$ACADVER")
+	dxf.group(1, "AC1009")
+	dxf.group(9, "$EXTMIN")
+	dxf.coord(10, 0)
+	dxf.coord(20, 0)
+	dxf.group(9, "$EXTMAX")
+	dxf.coord(10, opts.paperSize.width)
+	dxf.coord(20, opts.paperSize.height)
+	dxf.group(0, "ENDSEC")
+
+	dxf.group(0, "SECTION")
+	dxf.group(2, "TABLES")
+	// The solid linetype that the layers use
+	dxf.group(0, "TABLE")
+	dxf.group(2, "LTYPE")
+	dxf.group(70, "1")
+	dxf.group(0, "LTYPE")
+	dxf.group(2, "CONTINUOUS")
+	dxf.group(70, "0")
+	dxf.group(3, "Solid line")
+	dxf.group(72, "65")
+	dxf.group(73, "0")
+	dxf.group(40, "0.0")
+	dxf.group(0, "ENDTAB")
+	// One layer for each threshold, with its own colour (1..7 in the AutoCAD Color Index)
+	dxf.group(0, "TABLE")
+	dxf.group(2, "LAYER")
+	dxf.group(70, fmt.Sprintf("%d", len(dxf.layerNames)))
+	for i, name := range dxf.layerNames {
+		dxf.group(0, "LAYER")
+		dxf.group(2, name)
+		dxf.group(70, "0")
+		dxf.group(62, fmt.Sprintf("%d", i%7+1))
+		dxf.group(6, "CONTINUOUS")
+	}
+	dxf.group(0, "ENDTAB")
+	dxf.group(0, "ENDSEC")
+
+	dxf.group(0, "SECTION")
+	dxf.group(2, "ENTITIES")
+	if opts.framewidth > 0.0 {
+		dxf.drawPath(dxf.placement.frame(opts), dxf.layerNames[0])
+	}
+	return dxf.placement.scale
+}
+
+func (dxf *DXFFile) plotLayer(layer *LayerT) {
+	for _, path := range layer.paths {
+		paperPath := make(ContourT, len(path))
+		for i, p := range path {
+			paperPath[i] = dxf.placement.toPaper(p)
+		}
+		dxf.drawPath(paperPath, dxf.layerNames[layer.index])
+	}
+}
+
+func (dxf *DXFFile) stopSave() {
+	dxf.group(0, "ENDSEC")
+	dxf.group(0, "EOF")
+	dxf.file.Close()
+	fmt.Printf("Created DXF file %q\n", dxf.filename)
+}
@@ -0,0 +1,125 @@
+// filter.go -- leaving out contours that are too small to be worth plotting
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Photos give thousands of contours round specks of one or two pixels,
+// which take longer to plot than they're worth.  Contours can be left out
+// if they're too short, or enclose too small an area, or if there are more
+// than a given number of them at a threshold.  When a contour is left out,
+// so are any inside it (such as holes in it), so that fills still work.
+
+// A length or area given on the command line: in mm (or mm²) on the paper,
+// or in pixels if it ends with 'px'.
+type SizeT struct {
+	value  float64
+	pixels bool
+}
+
+func (s SizeT) String() string {
+	if s.pixels {
+		return fmt.Sprintf("%gpx", s.value)
+	}
+	return fmt.Sprintf("%g", s.value)
+}
+
+// Parse a size such as '2', '2mm', or '10px'
+func parseSize(spec string) (SizeT, error) {
+	var size SizeT
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if strings.HasSuffix(spec, "px") {
+		size.pixels = true
+		spec = strings.TrimSuffix(spec, "px")
+	} else {
+		spec = strings.TrimSuffix(strings.TrimSuffix(spec, "mm2"), "mm")
+	}
+	value, err := strconv.ParseFloat(spec, 64)
+	if err != nil || value < 0 {
+		return size, fmt.Errorf("invalid size '%s'", spec)
+	}
+	size.value = value
+	return size, nil
+}
+
+// The size in pixels, given the size of a pixel on the paper, in mm.
+// power is 1 for lengths, and 2 for areas.
+func (s SizeT) inPixels(scale float64, power int) float64 {
+	if s.pixels {
+		return s.value
+	}
+	return s.value / math.Pow(scale, float64(power))
+}
+
+// Whether any of --min-length, --min-area, and --max-count have been given
+func filtering(opts OptsT) bool {
+	return opts.minLength.value > 0 || opts.minArea.value > 0 || opts.maxCount > 0
+}
+
+// Leave out the contours that are too small, as given by --min-length and
+// --min-area, and all but the longest --max-count of them, along with any
+// that are inside those.  scale is the size of a pixel on the paper, in mm.
+// Returns the contours that are left, in the order they were found, and how
+// many have been dropped.
+func filterContours(contours ContourS, opts OptsT, scale float64) (ContourS, int) {
+	minLength := opts.minLength.inPixels(scale, 1)
+	minArea := opts.minArea.inPixels(scale, 2)
+	lengths := make([]float64, len(contours))
+	dropped := make([]bool, len(contours))
+	for i, contour := range contours {
+		lengths[i] = contour.Length()
+		dropped[i] = lengths[i] < minLength || math.Abs(contour.SignedArea()) < minArea
+	}
+	if opts.maxCount > 0 {
+		// the longest ones that are left
+		kept := make([]int, 0, len(contours))
+		for i := range contours {
+			if !dropped[i] {
+				kept = append(kept, i)
+			}
+		}
+		slices.SortStableFunc(kept, func(a, b int) int {
+			return cmp.Compare(lengths[b], lengths[a])
+		})
+		for _, i := range kept[min(opts.maxCount, len(kept)):] {
+			dropped[i] = true
+		}
+	}
+	// Drop the contours inside dropped ones
+	nodes := nestContours(contours, nil)
+	for i := range contours {
+		for p := nodes[i].parent; p >= 0 && !dropped[i]; p = nodes[p].parent {
+			dropped[i] = dropped[p]
+		}
+	}
+	kept := make(ContourS, 0, len(contours))
+	for i, contour := range contours {
+		if !dropped[i] {
+			kept = append(kept, contour)
+		}
+	}
+	return kept, len(contours) - len(kept)
+}
@@ -0,0 +1,167 @@
+// gcode.go -- G-code output for pen plotters and CNC machines
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Ways of lifting and lowering the pen, as given by --gcode-pen
+var gcodePens = []string{"z", "servo"}
+
+// Where the machine's origin is on the paper, as given by --gcode-origin
+var gcodeOrigins = []string{"bottom-left", "top-left", "centre"}
+
+// G-code follows the usual machine convention: X to the right and Y away
+// from the operator (i.e. up the page), in mm.  Contours are drawn at the
+// same size and in the same place on the paper as in the SVG.
+type GcodeFile struct {
+	file       *os.File
+	filename   string
+	placement  PlacementT
+	opts       OptsT
+	layerCount int
+	penIsDown  bool
+}
+
+func (gc *GcodeFile) write(s string) {
+	fmt.Fprint(gc.file, s)
+}
+
+func (gc *GcodeFile) writeComment(s string) {
+	gc.write("; " + s + "\n")
+}
+
+func (gc *GcodeFile) open(filename string) {
+	gc.filename = filename
+	gc.file = createFile(filename)
+}
+
+// Convert a point on the paper (in mm from the top left) to machine coordinates.
+func (gc *GcodeFile) toMachine(p Point64T) Point64T {
+	paper := gc.opts.paperSize
+	switch gc.opts.gcodeOrigin {
+	case "top-left":
+		return Point64T{p.x, -p.y}
+	case "centre":
+		return Point64T{p.x - paper.width/2, paper.height/2 - p.y}
+	}
+	return Point64T{p.x, paper.height - p.y}
+}
+
+func (gc *GcodeFile) penUp() {
+	if !gc.penIsDown {
+		return
+	}
+	if gc.opts.gcodePen == "servo" {
+		gc.write(fmt.Sprintf("M3 S%g\n", gc.opts.penUp))
+	} else {
+		gc.write(fmt.Sprintf("G0 Z%.3f\n", gc.opts.penUp))
+	}
+	gc.dwell()
+	gc.penIsDown = false
+}
+
+func (gc *GcodeFile) penDown() {
+	if gc.penIsDown {
+		return
+	}
+	if gc.opts.gcodePen == "servo" {
+		gc.write(fmt.Sprintf("M3 S%g\n", gc.opts.penDown))
+	} else {
+		gc.write(fmt.Sprintf("G1 Z%.3f F%g\n", gc.opts.penDown, gc.opts.feedRate))
+	}
+	gc.dwell()
+	gc.penIsDown = true
+}
+
+// Give the pen time to move
+func (gc *GcodeFile) dwell() {
+	if gc.opts.penDelay > 0 {
+		gc.write(fmt.Sprintf("G4 P%g\n", gc.opts.penDelay))
+	}
+}
+
+// Move with the pen up, either as fast as possible or at the travel rate.
+func (gc *GcodeFile) travel(p Point64T) {
+	gc.penUp()
+	if gc.opts.travelRate > 0 {
+		gc.write(fmt.Sprintf("G1 X%.3f Y%.3f F%g\n", p.x, p.y, gc.opts.travelRate))
+	} else {
+		gc.write(fmt.Sprintf("G0 X%.3f Y%.3f\n", p.x, p.y))
+	}
+}
+
+// Draw a path, given in mm on the paper.
+func (gc *GcodeFile) drawPath(path ContourT) {
+	if len(path) < 2 {
+		return
+	}
+	gc.travel(gc.toMachine(path[0]))
+	gc.penDown()
+	for i, p := range path[1:] {
+		p = gc.toMachine(p)
+		if i == 0 {
+			gc.write(fmt.Sprintf("G1 X%.3f Y%.3f F%g\n", p.x, p.y, gc.opts.feedRate))
+		} else {
+			gc.write(fmt.Sprintf("G1 X%.3f Y%.3f\n", p.x, p.y))
+		}
+	}
+}
+
+func (gc *GcodeFile) start(opts OptsT) (scale float64) {
+	gc.opts = opts
+	gc.placement = newPlacement(opts)
+	gc.write("G21 ; millimetres\n")
+	gc.write("G90 ; absolute coordinates\n")
+	// Make sure the pen's up before going anywhere
+	gc.penIsDown = true
+	gc.penUp()
+	if opts.framewidth > 0.0 {
+		gc.writeComment("frame")
+		gc.drawPath(gc.placement.frame(opts))
+	}
+	return gc.placement.scale
+}
+
+func (gc *GcodeFile) plotLayer(layer *LayerT) {
+	gc.penUp()
+	if gc.opts.penChange && gc.layerCount > 0 {
+		gc.write(fmt.Sprintf("M0 ; change pen for %g %s\n", layer.threshold, layer.label))
+	}
+	gc.layerCount++
+	gc.writeComment(fmt.Sprintf("layer %g %s", layer.threshold, layer.label))
+	for _, path := range layer.paths {
+		paperPath := make(ContourT, len(path))
+		for i, p := range path {
+			paperPath[i] = gc.placement.toPaper(p)
+		}
+		gc.drawPath(paperPath)
+	}
+	gc.penUp()
+}
+
+func (gc *GcodeFile) stopSave() {
+	gc.penUp()
+	gc.write("G0 X0 Y0\n")
+	gc.write("M2\n")
+	gc.file.Close()
+	fmt.Printf("Created G-code file %q\n", gc.filename)
+}
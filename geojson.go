@@ -0,0 +1,171 @@
+// geojson.go -- GeoJSON output for GIS and web maps
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// GeoJSON output is a FeatureCollection, with a feature for each contour
+// (or piece of a contour, if it's been broken at the edge of the image).
+// Coordinates are in pixels, with y going down, unless the input has a
+// georeference, in which case they're real-world coordinates in whatever
+// system the input uses.
+type GeoJSONFile struct {
+	file     *os.File
+	filename string
+	geo      *GeoRefT
+	width    float64
+	height   float64
+	features int
+	comments []string
+}
+
+type geoJSONGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+type geoJSONProperties struct {
+	Threshold float64  `json:"threshold"`
+	Label     string   `json:"label"`
+	Length    float64  `json:"length"`
+	Area      *float64 `json:"area,omitempty"` // only for polygons
+	Clipped   bool     `json:"clipped"`        // broken or clipped at the edge of the image or data
+}
+
+type geoJSONFeature struct {
+	Type       string            `json:"type"`
+	Geometry   geoJSONGeometry   `json:"geometry"`
+	Properties geoJSONProperties `json:"properties"`
+}
+
+func (gj *GeoJSONFile) write(s string) {
+	fmt.Fprint(gj.file, s)
+}
+
+// GeoJSON doesn't have comments, so they're gathered up and written
+// as a list at the end of the FeatureCollection.
+func (gj *GeoJSONFile) writeComment(s string) {
+	gj.comments = append(gj.comments, s)
+}
+
+func (gj *GeoJSONFile) open(filename string) {
+	gj.filename = filename
+	gj.file = createFile(filename)
+}
+
+// Convert a point to output coordinates: real-world ones if there's a
+// georeference, otherwise pixels (to 3 decimal places).
+func (gj *GeoJSONFile) toOutput(p Point64T) Point64T {
+	if gj.geo != nil {
+		return gj.geo.toWorld(p)
+	}
+	return Point64T{math.Round(p.x*1000) / 1000, math.Round(p.y*1000) / 1000}
+}
+
+// Has the path been broken at, or does it go along or over, the edge of the
+// image or the data?
+func (gj *GeoJSONFile) clipped(path ContourT) bool {
+	if !path.IsClosed() {
+		return true
+	}
+	for _, p := range path {
+		if p.x <= 0 || p.y <= 0 || p.x >= gj.width || p.y >= gj.height {
+			return true
+		}
+	}
+	return false
+}
+
+func (gj *GeoJSONFile) start(opts OptsT) (scale float64) {
+	gj.geo = opts.geo
+	gj.width = float64(opts.width)
+	gj.height = float64(opts.height)
+	gj.write("{\"type\": \"FeatureCollection\", \"features\": [\n")
+	// the scale is only used for reporting lengths on the paper
+	return newPlacement(opts).scale
+}
+
+func (gj *GeoJSONFile) plotLayer(layer *LayerT) {
+	for _, path := range layer.paths {
+		if len(path) < 2 {
+			continue
+		}
+		out := make(ContourT, len(path))
+		for i, p := range path {
+			out[i] = gj.toOutput(p)
+		}
+		feature := geoJSONFeature{
+			Type: "Feature",
+			Properties: geoJSONProperties{
+				Threshold: layer.threshold,
+				Label:     layer.label,
+				Length:    out.Length(),
+				Clipped:   gj.clipped(path),
+			},
+		}
+		if out.IsClosed() && len(out) >= 4 {
+			// RFC 7946 wants the outside of a polygon to go anticlockwise,
+			// taking the coordinates as they are (with y going up)
+			area := out.SignedArea()
+			if area < 0 {
+				// reverse it
+				for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+					out[i], out[j] = out[j], out[i]
+				}
+			}
+			area = math.Abs(area)
+			feature.Properties.Area = &area
+			feature.Geometry = geoJSONGeometry{"Polygon", [][][2]float64{positions(out)}}
+		} else {
+			feature.Geometry = geoJSONGeometry{"LineString", positions(out)}
+		}
+		js, err := json.Marshal(feature)
+		if err != nil {
+			panic(fmt.Sprintf("GeoJSONFile.plotLayer: can't encode feature: %s", err))
+		}
+		if gj.features > 0 {
+			gj.write(",\n")
+		}
+		gj.write(string(js))
+		gj.features++
+	}
+}
+
+func positions(c ContourT) [][2]float64 {
+	pos := make([][2]float64, len(c))
+	for i, p := range c {
+		pos[i] = [2]float64{p.x, p.y}
+	}
+	return pos
+}
+
+func (gj *GeoJSONFile) stopSave() {
+	comments, err := json.Marshal(gj.comments)
+	if err != nil {
+		panic(fmt.Sprintf("GeoJSONFile.stopSave: can't encode comments: %s", err))
+	}
+	gj.write(fmt.Sprintf("\n], \"comments\": %s}\n", comments))
+	gj.file.Close()
+	fmt.Printf("Created GeoJSON file %q\n", gj.filename)
+}
@@ -0,0 +1,348 @@
+// geotiff.go -- reading single-band GeoTIFF rasters as height maps
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Only the parts of TIFF that elevation rasters tend to use are supported:
+// one sample per pixel, 8 to 64 bits, integer or floating point,
+// in strips or tiles, uncompressed or deflated, with or without
+// horizontal differencing.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// TIFF tags that we care about
+const (
+	tiffImageWidth          = 256
+	tiffImageLength         = 257
+	tiffBitsPerSample       = 258
+	tiffCompression         = 259
+	tiffStripOffsets        = 273
+	tiffSamplesPerPixel     = 277
+	tiffRowsPerStrip        = 278
+	tiffStripByteCounts     = 279
+	tiffPredictor           = 317
+	tiffTileWidth           = 322
+	tiffTileLength          = 323
+	tiffTileOffsets         = 324
+	tiffTileByteCounts      = 325
+	tiffSampleFormat        = 339
+	tiffModelPixelScale     = 33550
+	tiffModelTiepoint       = 33922
+	tiffModelTransformation = 34264
+	tiffGeoKeyDirectory     = 34735
+	tiffGDALNoData          = 42113
+)
+
+// Sizes of the TIFF field types, indexed by type number
+var tiffTypeSize = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+type tiffEntryT struct {
+	typ   int
+	count int
+	data  []byte // the raw value(s)
+}
+
+type tiffFileT struct {
+	buf     []byte
+	order   binary.ByteOrder
+	entries map[int]tiffEntryT
+}
+
+// Get a tag's values as numbers.
+func (tf *tiffFileT) values(tag int) []float64 {
+	entry, ok := tf.entries[tag]
+	if !ok {
+		return nil
+	}
+	vals := make([]float64, entry.count)
+	d := entry.data
+	for i := range vals {
+		switch entry.typ {
+		case 1, 7: // BYTE, UNDEFINED
+			vals[i] = float64(d[i])
+		case 6: // SBYTE
+			vals[i] = float64(int8(d[i]))
+		case 3: // SHORT
+			vals[i] = float64(tf.order.Uint16(d[i*2:]))
+		case 8: // SSHORT
+			vals[i] = float64(int16(tf.order.Uint16(d[i*2:])))
+		case 4: // LONG
+			vals[i] = float64(tf.order.Uint32(d[i*4:]))
+		case 9: // SLONG
+			vals[i] = float64(int32(tf.order.Uint32(d[i*4:])))
+		case 5: // RATIONAL
+			vals[i] = float64(tf.order.Uint32(d[i*8:])) / float64(tf.order.Uint32(d[i*8+4:]))
+		case 10: // SRATIONAL
+			vals[i] = float64(int32(tf.order.Uint32(d[i*8:]))) / float64(int32(tf.order.Uint32(d[i*8+4:])))
+		case 11: // FLOAT
+			vals[i] = float64(math.Float32frombits(tf.order.Uint32(d[i*4:])))
+		case 12: // DOUBLE
+			vals[i] = math.Float64frombits(tf.order.Uint64(d[i*8:]))
+		}
+	}
+	return vals
+}
+
+// Get a tag's single value, or the default if it's not there.
+func (tf *tiffFileT) value(tag int, dflt int) int {
+	vals := tf.values(tag)
+	if len(vals) == 0 {
+		return dflt
+	}
+	return int(vals[0])
+}
+
+func (tf *tiffFileT) ascii(tag int) string {
+	entry, ok := tf.entries[tag]
+	if !ok || entry.typ != 2 {
+		return ""
+	}
+	return strings.TrimRight(string(entry.data), "\x00")
+}
+
+// Read the header and first IFD.
+func parseTIFF(buf []byte) (*tiffFileT, error) {
+	if len(buf) < 8 {
+		return nil, fmt.Errorf("too short for a TIFF file")
+	}
+	tf := &tiffFileT{buf: buf, entries: make(map[int]tiffEntryT)}
+	switch string(buf[0:2]) {
+	case "II":
+		tf.order = binary.LittleEndian
+	case "MM":
+		tf.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+	switch tf.order.Uint16(buf[2:]) {
+	case 42:
+	case 43:
+		return nil, fmt.Errorf("BigTIFF files are not supported")
+	default:
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+	ifd := int(tf.order.Uint32(buf[4:]))
+	if ifd+2 > len(buf) {
+		return nil, fmt.Errorf("corrupt TIFF file")
+	}
+	n := int(tf.order.Uint16(buf[ifd:]))
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(buf) {
+			return nil, fmt.Errorf("corrupt TIFF file")
+		}
+		tag := int(tf.order.Uint16(buf[e:]))
+		typ := int(tf.order.Uint16(buf[e+2:]))
+		count := int(tf.order.Uint32(buf[e+4:]))
+		if typ < 1 || typ >= len(tiffTypeSize) {
+			continue // unknown type -- skip it
+		}
+		size := count * tiffTypeSize[typ]
+		start := e + 8
+		if size > 4 {
+			start = int(tf.order.Uint32(buf[e+8:]))
+		}
+		if start+size > len(buf) {
+			return nil, fmt.Errorf("corrupt TIFF file")
+		}
+		tf.entries[tag] = tiffEntryT{typ: typ, count: count, data: buf[start : start+size]}
+	}
+	return tf, nil
+}
+
+// loadGeoTIFF loads the first image in a (Geo)TIFF file.
+func loadGeoTIFF(path string) (*HeightMapT, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input raster: %s, %s", path, err)
+	}
+	tf, err := parseTIFF(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode raster: %s, %s", path, err)
+	}
+	hm, err := tf.decode()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode raster: %s, %s", path, err)
+	}
+	return hm, nil
+}
+
+func (tf *tiffFileT) decode() (*HeightMapT, error) {
+	width := tf.value(tiffImageWidth, 0)
+	height := tf.value(tiffImageLength, 0)
+	if width < 1 || height < 1 {
+		return nil, fmt.Errorf("invalid image size %d x %d", width, height)
+	}
+	if spp := tf.value(tiffSamplesPerPixel, 1); spp != 1 {
+		return nil, fmt.Errorf("only single-band rasters are supported, not %d bands", spp)
+	}
+	bps := tf.value(tiffBitsPerSample, 1)
+	format := tf.value(tiffSampleFormat, 1) // 1: unsigned, 2: signed, 3: float
+	switch {
+	case format == 3 && (bps == 32 || bps == 64):
+	case format != 3 && (bps == 8 || bps == 16 || bps == 32):
+	default:
+		return nil, fmt.Errorf("unsupported sample format %d with %d bits", format, bps)
+	}
+	compression := tf.value(tiffCompression, 1)
+	if compression != 1 && compression != 8 && compression != 32946 {
+		return nil, fmt.Errorf("unsupported compression %d (only none or deflate)", compression)
+	}
+	predictor := tf.value(tiffPredictor, 1)
+	if predictor != 1 && !(predictor == 2 && format != 3) {
+		return nil, fmt.Errorf("unsupported predictor %d", predictor)
+	}
+
+	// Strips are just tiles that are as wide as the image
+	chunkWidth := width
+	chunkHeight := tf.value(tiffRowsPerStrip, height)
+	offsets := tf.values(tiffStripOffsets)
+	counts := tf.values(tiffStripByteCounts)
+	if _, tiled := tf.entries[tiffTileOffsets]; tiled {
+		chunkWidth = tf.value(tiffTileWidth, 0)
+		chunkHeight = tf.value(tiffTileLength, 0)
+		offsets = tf.values(tiffTileOffsets)
+		counts = tf.values(tiffTileByteCounts)
+	}
+	if chunkWidth < 1 || chunkHeight < 1 || len(offsets) == 0 || len(offsets) != len(counts) {
+		return nil, fmt.Errorf("missing or invalid strip or tile layout")
+	}
+	across := (width + chunkWidth - 1) / chunkWidth
+	bytesPerSample := bps / 8
+
+	hm := newHeightMap(width, height)
+	hm.integral = format != 3
+	for i := range offsets {
+		start := int(offsets[i])
+		end := start + int(counts[i])
+		if start < 0 || end > len(tf.buf) {
+			return nil, fmt.Errorf("strip or tile %d is outside the file", i)
+		}
+		data := tf.buf[start:end]
+		if compression != 1 {
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			data, err = io.ReadAll(zr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		x0 := (i % across) * chunkWidth
+		y0 := (i / across) * chunkHeight
+		for y := 0; y < chunkHeight && y0+y < height; y++ {
+			prev := 0.0
+			for x := 0; x < chunkWidth; x++ {
+				offset := (y*chunkWidth + x) * bytesPerSample
+				if offset+bytesPerSample > len(data) {
+					return nil, fmt.Errorf("strip or tile %d is too short", i)
+				}
+				v := tf.sample(data[offset:], bps, format)
+				if predictor == 2 {
+					v = tf.wrap(prev+v, bps, format)
+					prev = v
+				}
+				if x0+x < width {
+					hm.set(x0+x, y0+y, v)
+				}
+			}
+		}
+	}
+
+	if nodata := strings.TrimSpace(tf.ascii(tiffGDALNoData)); nodata != "" {
+		if v, err := strconv.ParseFloat(nodata, 64); err == nil {
+			hm.setNoData(v)
+		}
+	}
+	hm.geo = tf.georeference()
+	return hm, nil
+}
+
+// Read one sample
+func (tf *tiffFileT) sample(d []byte, bps, format int) float64 {
+	switch bps {
+	case 8:
+		if format == 2 {
+			return float64(int8(d[0]))
+		}
+		return float64(d[0])
+	case 16:
+		if format == 2 {
+			return float64(int16(tf.order.Uint16(d)))
+		}
+		return float64(tf.order.Uint16(d))
+	case 32:
+		switch format {
+		case 2:
+			return float64(int32(tf.order.Uint32(d)))
+		case 3:
+			return float64(math.Float32frombits(tf.order.Uint32(d)))
+		}
+		return float64(tf.order.Uint32(d))
+	}
+	return math.Float64frombits(tf.order.Uint64(d))
+}
+
+// Integer arithmetic for undoing the predictor wraps around
+func (tf *tiffFileT) wrap(v float64, bps, format int) float64 {
+	modulus := math.Exp2(float64(bps))
+	v = math.Mod(v, modulus)
+	if v < 0 {
+		v += modulus
+	}
+	if format == 2 && v >= modulus/2 {
+		v -= modulus
+	}
+	return v
+}
+
+// Work out where the raster is, from the GeoTIFF tags, if there are any.
+func (tf *tiffFileT) georeference() *GeoRefT {
+	var geo GeoRefT
+	if m := tf.values(tiffModelTransformation); len(m) == 16 {
+		geo = GeoRefT{a: m[0], b: m[1], c: m[3], d: m[4], e: m[5], f: m[7]}
+	} else {
+		scale := tf.values(tiffModelPixelScale)
+		tie := tf.values(tiffModelTiepoint)
+		if len(scale) < 2 || len(tie) < 6 {
+			return nil
+		}
+		geo = GeoRefT{a: scale[0], e: -scale[1], c: tie[3] - tie[0]*scale[0], f: tie[4] + tie[1]*scale[1]}
+	}
+	// GTRasterTypeGeoKey (1025) is 2 for PixelIsPoint, which puts the model
+	// coordinates at pixel centres rather than at their top-left corners.
+	keys := tf.values(tiffGeoKeyDirectory)
+	for k := 4; k+3 < len(keys); k += 4 {
+		if keys[k] == 1025 && keys[k+1] == 0 && keys[k+3] == 2 {
+			geo.c -= (geo.a + geo.b) / 2
+			geo.f -= (geo.d + geo.e) / 2
+		}
+	}
+	return &geo
+}
@@ -17,9 +17,21 @@ package main
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -43,7 +55,7 @@ func TestPWA(t *testing.T) {
 	fmt.Println("TestPWA")
 	type testdataT struct {
 		outPt, inPt              PointT
-		outPix, inPix, threshold int
+		outPix, inPix, threshold float64
 		width, height            int
 		wanted                   Point64T
 	}
@@ -74,30 +86,22 @@ func TestFilename(t *testing.T) {
 		opts   OptsT
 		wanted string
 	}
-	/*
-		infile     string
-		width      int
-		height     int
-		thresholds []int
-		tcount     int
-		margin     float64
-		paper      string
-		paperSize  RectangleT
-		image      bool
-		clip       bool
-		dev        bool
-		linewidth  float64
-		framewidth float64
-		colours    string // two hex colours, e.g. "0033ff,0c4088"
-	*/
 	testdata := []testdataT{
-		{OptsT{"file1.png", 100, 200, []int{44, 55}, -1, 15.0, "5x7", RectangleT{0, 0}, true, false, true, 1.0, 0.0, ""},
+		{OptsT{infile: "file1.png", width: 100, height: 200, thresholds: []float64{44, 55}, tcount: -1, margin: 15.0, paper: "5x7",
+			image: true, debug: true, linewidth: 1.0},
 			"file1-hc-t44,55m15p5x7I.svg"},
-		{OptsT{"file1.png", 100, 200, []int{}, 3, 10.3, "200x300", RectangleT{0, 0}, false, true, false, 1.0, 2.0, ""},
+		{OptsT{infile: "file1.png", width: 100, height: 200, thresholds: []float64{}, tcount: 3, margin: 10.3, paper: "200x300",
+			clip: true, linewidth: 1.0, framewidth: 2.0},
 			"file1-hc-T3m10.3p200x300F2C.svg"},
+		{OptsT{infile: "dem.asc", tcount: 1, interval: 10, base: 5, valueRange: []float64{120, 1340}, margin: 15, paper: "A4L"},
+			"dem-hc-i10b5v120,1340m15pA4L.svg"},
+		{OptsT{infile: "file1.png", thresholds: []float64{128}, tcount: -1, margin: 15, paper: "A4L", clip: true, clipGeometry: true, clipInset: 2, colours: "ff0000-0000ff"},
+			"file1-hc-t128m15pA4LGn2Cff0000-0000ff.svg"},
+		{OptsT{infile: "file1.png", thresholds: []float64{128}, tcount: -1, margin: 15, paper: "A4L", clip: true, clipInset: 2.5},
+			"file1-hc-t128m15pA4LCn2.5.svg"},
 	}
 	for i, td := range testdata {
-		filename := buildSVGfilename(td.opts)
+		filename := buildFilename(td.opts)
 		if filename != td.wanted {
 			t.Errorf("(%d) Wrong filename: wanted '%s' got '%s'\n", i, td.wanted, filename)
 		}
@@ -123,7 +127,7 @@ func TestSetColours(t *testing.T) {
 	}
 	for _, td := range testdata {
 		svg := new(SVGfile)
-		svg.thresholds = make([]int, td.tcount+1) // plus 1 for the background
+		svg.thresholds = make([]float64, td.tcount+1) // plus 1 for the background
 		svg.setColours(td.colourString)
 		if !equalStringSlice(svg.colours, td.colours) {
 			t.Errorf("Wrong result for test %d: %s / %d.  Wanted '%s'  got '%s'\n", td.id, td.colourString, td.tcount, td.colours, svg.colours)
@@ -159,7 +163,7 @@ func TestTraceContour(t *testing.T) {
 		if err != nil {
 			t.Errorf("Input file %s not found\n", td.infile)
 		}
-		got, _, length := traceContour(img, width, height, 128, td.start, nil)
+		got, _, length := traceContour(img, width, height, 128, td.start)
 		if !almostEqual(length, td.length, 0.001) {
 			t.Errorf("Wrong result for %s (wanted length %.3f  got %.3f)\n", td.infile, td.length, length)
 		}
@@ -238,7 +242,7 @@ func TestContourFinder(t *testing.T) {
 		if err != nil {
 			t.Errorf("Input file %s not found\n", td.infile)
 		}
-		contours, length := contourFinder(img, width, height, 128, false, nil)
+		contours, length := contourFinder(img, width, height, 128)
 		if len(contours) != td.count {
 			t.Errorf("Wrong result for %s (wanted count %v  got %v)\n", td.infile, td.count, len(contours))
 		}
@@ -290,7 +294,7 @@ func TestCreateSVG(t *testing.T) {
 	type testdataT struct {
 		infile     string
 		outfile    string
-		thresholds []int
+		thresholds []float64
 		margin     float64
 		framewidth float64
 		paper      string
@@ -299,13 +303,13 @@ func TestCreateSVG(t *testing.T) {
 		wanted     string
 	}
 	testdata := []testdataT{ // Compression is done for SVG contours
-		{"tests/test3.png", "tests/test3-hc-t128m15pA4LF2.svg", []int{128}, 15, 2.0, "A4L", false, "",
+		{"tests/test3.png", "tests/test3-hc-t128m15pA4LF2.svg", []float64{128}, 15, 2.0, "A4L", false, "",
 			"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<!-- tests/test3-hc-t128m15pA4LF2.svg, created by hcontours.test version 0.1.2 -->\n<!-- Options used: infile: \"tests/test3.png\", width: 8, height: 8, thresholds: [128], tcount: -1, margin: 15.00, paper: \"A4L\", paperSize: {297.00, 210.00}, image: false, clip: false, debug: false, linewidth: 1.00, framewidth: 2.00, colours: \"\" -->\n<svg width=\"297mm\" height=\"210mm\" viewBox=\"0 0 297 210\" style=\"background-color:white\" xmlns=\"http://www.w3.org/2000/svg\" xmlns:inkscape=\"http://www.inkscape.org/namespaces/inkscape\" encoding=\"UTF-8\" >\n<g stroke=\"black\" stroke-width=\"0.0455\" stroke-linecap=\"round\" stroke-linejoin=\"round\" fill=\"none\" transform=\"translate(60.5000,17.0000) scale(22.0000)\">\n<g inkscape:groupmode=\"layer\" inkscape:label=\"0 background\" stroke=\"black\"  >\n<rect id=\"frame\" width=\"8.0909\" height=\"8.0909\" x=\"-0.0455\" y=\"-0.0455\" stroke-width=\"0.0909\" />\n</g>\n<g inkscape:groupmode=\"layer\" inkscape:label=\"128 contour\" stroke=\"black\"  >\n<polyline id=\"0\" points=\"1.00,0.50 1.50,0.00 \" />\n<polyline id=\"1\" points=\"2.50,0.00 3.00,0.50 3.00,1.50 1.50,3.00 0.50,3.00 0.00,2.50 \" />\n<polyline id=\"2\" points=\"0.00,1.50 1.00,0.50 \" />\n<polyline id=\"3\" points=\"4.00,0.50 4.50,0.00 \" />\n<polyline id=\"4\" points=\"0.00,4.50 0.50,4.00 2.50,4.00 4.00,2.50 4.00,0.50 \" />\n<polygon id=\"0\"  points=\"5.00,4.50 5.50,4.00 6.00,4.50 6.00,5.50 5.50,6.00 4.50,6.00 4.00,5.50 5.00,4.50 \" />\n</g>\n<!-- 3 contours found at threshold 128, with length 1.00m -->\n<!-- Total contour length: 1.00m -->\n</g>\n</svg>\n",
 		},
-		{"tests/test4.png", "tests/test4-hc-t100,200m15pA4PC.svg", []int{100, 200}, 15, 0.0, "A4P", true, "",
-			"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<!-- tests/test4-hc-t100,200m15pA4PC.svg, created by hcontours.test version 0.1.2 -->\n<!-- Options used: infile: \"tests/test4.png\", width: 6, height: 4, thresholds: [100 200], tcount: -1, margin: 15.00, paper: \"A4P\", paperSize: {210.00, 297.00}, image: false, clip: true, debug: false, linewidth: 1.00, framewidth: 0.00, colours: \"\" -->\n<svg width=\"210mm\" height=\"297mm\" viewBox=\"0 0 210 297\" style=\"background-color:white\" xmlns=\"http://www.w3.org/2000/svg\" xmlns:inkscape=\"http://www.inkscape.org/namespaces/inkscape\" encoding=\"UTF-8\" >\n<g stroke=\"black\" stroke-width=\"0.0333\" stroke-linecap=\"round\" stroke-linejoin=\"round\" fill=\"none\" transform=\"translate(15.0000,88.5000) scale(30.0000)\">\n<defs><clipPath id=\"clip1\" ><rect id=\"cliprect\" width=\"5.9667\" height=\"3.9667\" x=\"0.0167\" y=\"0.0167\" /></clipPath></defs>\n<g inkscape:groupmode=\"layer\" inkscape:label=\"0 background\" stroke=\"black\"  >\n</g>\n<g inkscape:groupmode=\"layer\" inkscape:label=\"200 contour\" stroke=\"black\"  >\n<path id=\"0\" clip-path=\"url(#clip1)\"  d=\"M 0.72,0.50 L 1.50,-0.00 L 2.28,0.50 L 3.28,1.50 L 3.28,2.50 L 2.28,3.50 L 1.50,4.00 L 0.72,3.50 L 0.50,3.28 L -0.00,2.50 L -0.00,1.50 L 0.50,0.72 L 0.72,0.50 Z M 3.72,0.50 L 4.50,-0.00 L 5.50,-0.00 L 6.00,0.50 L 6.00,1.50 L 5.50,2.28 L 4.50,2.28 L 3.72,1.50 L 3.72,0.50 Z M 3.72,3.50 L 4.50,2.72 L 5.28,3.50 L 4.50,4.00 L 3.72,3.50 Z \" />\n</g>\n<g inkscape:groupmode=\"layer\" inkscape:label=\"100 contour\" stroke=\"black\"  >\n<path id=\"1\" clip-path=\"url(#clip1)\"  d=\"M 1.11,0.50 L 1.50,-0.00 L 1.89,0.50 L 2.89,1.50 L 2.89,2.50 L 1.89,3.50 L 1.50,4.00 L 1.11,3.50 L 0.50,2.89 L -0.00,2.50 L -0.00,1.50 L 0.50,1.11 L 1.11,0.50 Z M 4.11,0.50 L 4.50,-0.00 L 5.50,-0.00 L 6.00,0.50 L 6.00,1.50 L 5.50,1.89 L 4.50,1.89 L 4.11,1.50 L 4.11,0.50 Z M 4.11,3.50 L 4.50,3.11 L 4.89,3.50 L 4.50,4.00 L 4.11,3.50 Z \" />\n</g>\n<!-- 3 contours found at threshold 100, with length 0.58m -->\n<!-- 3 contours found at threshold 200, with length 0.68m -->\n<!-- Total contour length: 1.26m -->\n</g>\n</svg>\n",
+		{"tests/test4.png", "tests/test4-hc-t100,200m15pA4PC.svg", []float64{100, 200}, 15, 0.0, "A4P", true, "",
+			"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<!-- tests/test4-hc-t100,200m15pA4PC.svg, created by hcontours.test version 0.1.2 -->\n<!-- Options used: infile: \"tests/test4.png\", width: 6, height: 4, thresholds: [100 200], tcount: -1, margin: 15.00, paper: \"A4P\", paperSize: {210.00, 297.00}, image: false, clip: true, debug: false, linewidth: 1.00, framewidth: 0.00, colours: \"\" -->\n<svg width=\"210mm\" height=\"297mm\" viewBox=\"0 0 210 297\" style=\"background-color:white\" xmlns=\"http://www.w3.org/2000/svg\" xmlns:inkscape=\"http://www.inkscape.org/namespaces/inkscape\" encoding=\"UTF-8\" >\n<g stroke=\"black\" stroke-width=\"0.0333\" stroke-linecap=\"round\" stroke-linejoin=\"round\" fill=\"none\" transform=\"translate(15.0000,88.5000) scale(30.0000)\">\n<defs><clipPath id=\"clip1\" ><rect id=\"cliprect\" width=\"5.9667\" height=\"3.9667\" x=\"0.0167\" y=\"0.0167\" /></clipPath></defs>\n<g inkscape:groupmode=\"layer\" inkscape:label=\"0 background\" stroke=\"black\"  >\n</g>\n<g inkscape:groupmode=\"layer\" inkscape:label=\"200 contour\" stroke=\"black\"  >\n<path id=\"0\" clip-path=\"url(#clip1)\"  d=\"M 0.72,0.50 L 1.47,0.02 L 1.53,0.02 L 2.28,0.50 L 3.28,1.50 L 3.28,2.50 L 2.28,3.50 L 1.53,3.98 L 1.47,3.98 L 0.72,3.50 L 0.50,3.28 L 0.02,2.53 L 0.02,1.47 L 0.50,0.72 L 0.72,0.50 Z M 3.72,0.50 L 4.47,0.02 L 5.52,0.02 L 5.98,0.48 L 5.98,1.53 L 5.50,2.28 L 4.50,2.28 L 3.72,1.50 L 3.72,0.50 Z M 4.47,3.98 L 3.72,3.50 L 4.50,2.72 L 5.28,3.50 L 4.53,3.98 L 4.47,3.98 Z \" />\n</g>\n<g inkscape:groupmode=\"layer\" inkscape:label=\"100 contour\" stroke=\"black\"  >\n<path id=\"1\" clip-path=\"url(#clip1)\"  d=\"M 1.11,0.50 L 1.49,0.02 L 1.51,0.02 L 1.89,0.50 L 2.89,1.50 L 2.89,2.50 L 1.89,3.50 L 1.51,3.98 L 1.49,3.98 L 1.11,3.50 L 0.50,2.89 L 0.02,2.51 L 0.02,1.49 L 0.50,1.11 L 1.11,0.50 Z M 4.11,0.50 L 4.49,0.02 L 5.52,0.02 L 5.98,0.48 L 5.98,1.51 L 5.50,1.89 L 4.50,1.89 L 4.11,1.50 L 4.11,0.50 Z M 4.49,3.98 L 4.11,3.50 L 4.50,3.11 L 4.89,3.50 L 4.51,3.98 L 4.49,3.98 Z \" />\n</g>\n<!-- 3 contours found at threshold 100, with length 0.58m -->\n<!-- 3 contours found at threshold 200, with length 0.68m -->\n<!-- Total contour length: 1.26m -->\n</g>\n</svg>\n",
 		},
-		{"tests/test7.png", "tests/test7-hc-t85,171m15pA4LCff7700-0077ff.svg", []int{85, 171}, 15, 0.0, "A4L", true, "ff7700-0077ff",
+		{"tests/test7.png", "tests/test7-hc-t85,171m15pA4LCff7700-0077ff.svg", []float64{85, 171}, 15, 0.0, "A4L", true, "ff7700-0077ff",
 			"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<!-- tests/test7-hc-t85,171m15pA4LCff7700-0077ff.svg, created by hcontours.test version 0.1.2 -->\n<!-- Options used: infile: \"tests/test7.png\", width: 5, height: 7, thresholds: [85 171], tcount: -1, margin: 15.00, paper: \"A4L\", paperSize: {297.00, 210.00}, image: false, clip: true, debug: false, linewidth: 1.00, framewidth: 0.00, colours: \"ff7700-0077ff\" -->\n<svg width=\"297mm\" height=\"210mm\" viewBox=\"0 0 297 210\" style=\"background-color:white\" xmlns=\"http://www.w3.org/2000/svg\" xmlns:inkscape=\"http://www.inkscape.org/namespaces/inkscape\" encoding=\"UTF-8\" >\n<g stroke=\"black\" stroke-width=\"0.0389\" stroke-linecap=\"round\" stroke-linejoin=\"round\" fill=\"none\" transform=\"translate(84.2143,15.0000) scale(25.7143)\">\n<defs><clipPath id=\"clip1\" ><rect id=\"cliprect\" width=\"4.9611\" height=\"6.9611\" x=\"0.0194\" y=\"0.0194\" /></clipPath></defs>\n<g inkscape:groupmode=\"layer\" inkscape:label=\"0 background\" stroke=\"black\" fill=\"#0077ff\" >\n<rect id=\"plotsize\" width=\"5\" height=\"7\" stroke=\"none\" />\n</g>\n<g inkscape:groupmode=\"layer\" inkscape:label=\"171 contour\" stroke=\"black\" fill=\"#7f7780\" >\n<path id=\"0\" clip-path=\"url(#clip1)\"  d=\"M 0.83,1.50 L 1.50,0.83 L 3.50,0.83 L 4.17,1.50 L 4.17,3.50 L 3.50,4.17 L 2.50,4.17 L 2.17,4.50 L 2.50,4.83 L 3.50,4.83 L 4.17,5.50 L 3.50,6.17 L 1.50,6.17 L 0.83,5.50 L 0.83,3.50 L 1.50,2.83 L 2.50,2.83 L 2.83,2.50 L 2.50,2.17 L 1.50,2.17 L 0.83,1.50 Z \" />\n</g>\n<g inkscape:groupmode=\"layer\" inkscape:label=\"85 contour\" stroke=\"black\" fill=\"#ff7700\" >\n<path id=\"1\" clip-path=\"url(#clip1)\"  d=\"M 1.17,1.50 L 1.50,1.17 L 3.50,1.17 L 3.83,1.50 L 3.83,3.50 L 3.50,3.83 L 2.50,3.83 L 1.83,4.50 L 2.50,5.17 L 3.50,5.17 L 3.83,5.50 L 3.50,5.83 L 1.50,5.83 L 1.17,5.50 L 1.17,3.50 L 1.50,3.17 L 2.50,3.17 L 3.17,2.50 L 2.50,1.83 L 1.50,1.83 L 1.17,1.50 Z \" />\n</g>\n<!-- 1 contours found at threshold 85, with length 0.50m -->\n<!-- 1 contours found at threshold 171, with length 0.55m -->\n<!-- Total contour length: 1.05m -->\n</g>\n</svg>\n",
 		},
 	}
@@ -313,7 +317,7 @@ func TestCreateSVG(t *testing.T) {
 		fmt.Printf("\t%s\n", td.infile)
 		opts := OptsT{infile: td.infile, thresholds: td.thresholds, tcount: -1, margin: td.margin, framewidth: td.framewidth, paper: td.paper, clip: td.clip, linewidth: 1, colours: td.colours}
 		parsePaperSize(&opts)
-		svgFilename := createSVG(opts)
+		svgFilename := createOutput(opts)
 		if svgFilename != td.outfile {
 			t.Errorf("Wrong filename for %s: wanted '%s' got '%s'\n", td.infile, td.outfile, svgFilename)
 		}
@@ -358,3 +362,1215 @@ func TestCompress(t *testing.T) {
 		}
 	}
 }
+
+func TestEvenThresholds(t *testing.T) {
+	fmt.Println("TestEvenThresholds")
+	type testdataT struct {
+		n         int
+		low, high float64
+		integral  bool
+		wanted    []float64
+	}
+	testdata := []testdataT{
+		{1, 0, 255, true, []float64{128}},
+		{3, 0, 255, true, []float64{64, 128, 192}},
+		{1, 0, 65535, true, []float64{32768}},
+		{4, 100, 200, false, []float64{120, 140, 160, 180}},
+	}
+	for i, td := range testdata {
+		got := evenThresholds(td.n, td.low, td.high, td.integral)
+		if floatsToString(got) != floatsToString(td.wanted) {
+			t.Errorf("(%d) Wrong thresholds: wanted %v got %v\n", i, td.wanted, got)
+		}
+	}
+}
+
+func TestChooseThresholds(t *testing.T) {
+	fmt.Println("TestChooseThresholds")
+	type testdataT struct {
+		id     string
+		opts   OptsT
+		wanted []float64
+	}
+	hm := newHeightMap(1, 1)
+	hm.low = 0
+	hm.high = 255
+	hm.integral = true
+	testdata := []testdataT{
+		{"tcount", OptsT{tcount: 3}, []float64{64, 128, 192}},
+		{"explicit", OptsT{tcount: -1, thresholds: []float64{10, 20}}, []float64{10, 20}},
+		{"interval", OptsT{tcount: 1, interval: 50}, []float64{50, 100, 150, 200, 250}},
+		{"interval with base", OptsT{tcount: 1, interval: 100, base: 30}, []float64{30, 130, 230}},
+		{"interval with limits", OptsT{tcount: 1, interval: 0.1, tmin: 0.15, tminSet: true, tmax: 0.45, tmaxSet: true}, []float64{0.2, 0.3, 0.4}},
+		{"interval including tmin", OptsT{tcount: 1, interval: 50, tmin: 0, tminSet: true, tmax: 100, tmaxSet: true}, []float64{0, 50, 100}},
+	}
+	for _, td := range testdata {
+		got, err := chooseThresholds(td.opts, hm)
+		if err != nil || floatsToString(got) != floatsToString(td.wanted) {
+			t.Errorf("Wrong thresholds for %s: wanted %v got %v (%v)\n", td.id, td.wanted, got, err)
+		}
+	}
+	if _, err := chooseThresholds(OptsT{tcount: 1, interval: 0.001}, hm); err == nil {
+		t.Errorf("Too many thresholds accepted\n")
+	}
+	// Black is 120, white is 1340
+	hm.values[0] = 51
+	hm.mapValues(120, 1340)
+	if hm.at(0, 0) != 364 || hm.low != 120 || hm.high != 1340 {
+		t.Errorf("Wrong mapped value: wanted 364 (120..1340), got %g (%g..%g)\n", hm.at(0, 0), hm.low, hm.high)
+	}
+	got, _ := chooseThresholds(OptsT{tcount: 1, interval: 250, base: 0}, hm)
+	if floatsToString(got) != "250,500,750,1000,1250" {
+		t.Errorf("Wrong thresholds for mapped values: got %v\n", got)
+	}
+}
+
+func TestAutoThresholds(t *testing.T) {
+	fmt.Println("TestAutoThresholds")
+	// Three equal clusters of values, around 20, 120, and 220
+	hm := newHeightMap(300, 1)
+	hm.high = 255
+	hm.integral = true
+	for i := range hm.values {
+		hm.values[i] = float64(20 + (i%3)*100 + i%2)
+	}
+	for _, method := range autoThresholdMethods {
+		got, err := autoThresholds(method, 2, hm)
+		if err != nil || len(got) != 2 || got[0] <= 21 || got[0] > 120 || got[1] <= 121 || got[1] > 220 {
+			t.Errorf("Wrong thresholds from %s: wanted one in 22..120 and one in 122..220, got %v (%v)\n", method, got, err)
+		}
+	}
+	// A flat grid of real heights has nothing to separate
+	flat := newHeightMap(10, 10)
+	for i := range flat.values {
+		flat.values[i] = 12.34
+	}
+	flat.low, flat.high = flat.valueRange()
+	for _, method := range autoThresholdMethods {
+		if got, err := autoThresholds(method, 3, flat); err == nil {
+			t.Errorf("Thresholds from %s for a flat grid should fail, got %v\n", method, got)
+		}
+	}
+	// No data at all
+	for i := range hm.values {
+		hm.values[i] = math.NaN()
+	}
+	for _, method := range autoThresholdMethods {
+		if got, err := autoThresholds(method, 2, hm); err == nil {
+			t.Errorf("Thresholds from %s with no data should fail, got %v\n", method, got)
+		}
+	}
+	// An image that's all transparent has no data either
+	path := filepath.Join(t.TempDir(), "clear.png")
+	fh, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Can't create %s: %s", path, err)
+	}
+	png.Encode(fh, image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+	fh.Close()
+	if _, _, _, err := loadHeightMap(OptsT{infile: path, alphaCutoff: 0.5}); err == nil {
+		t.Errorf("Loading an image with no data should fail\n")
+	}
+}
+
+func TestHeightMap16(t *testing.T) {
+	fmt.Println("TestHeightMap16")
+	// Two values that would be the same pixel value in 8 bits
+	img := image.NewGray16(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			img.SetGray16(x, y, color.Gray16{Y: 40000})
+		}
+	}
+	img.SetGray16(1, 1, color.Gray16{Y: 39990})
+	img.SetGray16(2, 1, color.Gray16{Y: 39990})
+	filename := filepath.Join(t.TempDir(), "gray16.png")
+	fh, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Can't create %s: %s", filename, err)
+	}
+	png.Encode(fh, img)
+	fh.Close()
+	hm, width, height, err := loadImage(filename)
+	if err != nil {
+		t.Fatalf("Can't load %s: %s", filename, err)
+	}
+	if hm.high != 65535 || hm.at(1, 1) != 39990 || hm.at(0, 0) != 40000 {
+		t.Errorf("Wrong 16-bit values: high=%v (1,1)=%v (0,0)=%v\n", hm.high, hm.at(1, 1), hm.at(0, 0))
+	}
+	contours, _ := contourFinder(hm, width, height, 39995)
+	if len(contours) != 1 {
+		t.Errorf("Wrong number of 16-bit contours: wanted 1 got %d\n", len(contours))
+	}
+}
+
+func TestGridReaders(t *testing.T) {
+	fmt.Println("TestGridReaders")
+	type testdataT struct {
+		infile        string
+		width, height int
+		low, high     float64
+		noData        PointT
+		threshold     float64
+		count         int
+		topLeft       *Point64T // nil if there's no georeference
+	}
+	// SRTM tile: 5x5, with a void in the top right and a pit in the middle
+	hgtFile := filepath.Join(t.TempDir(), "N51W002.hgt")
+	hgt := make([]byte, 5*5*2)
+	for i := 0; i < 25; i++ {
+		v := uint16(300)
+		switch i {
+		case 4:
+			v = 0x8000 // -32768
+		case 12:
+			v = 250
+		}
+		hgt[i*2] = byte(v >> 8)
+		hgt[i*2+1] = byte(v)
+	}
+	if err := os.WriteFile(hgtFile, hgt, 0644); err != nil {
+		t.Fatalf("Can't create %s: %s", hgtFile, err)
+	}
+	testdata := []testdataT{
+		{"tests/grid.asc", 6, 5, 100, 110.5, PointT{5, 0}, 105, 1, &Point64T{385000, 804250}},
+		{"tests/grid.csv", 5, 4, 1, 9, PointT{2, 2}, 5, 1, nil},
+		{hgtFile, 5, 5, 250, 300, PointT{4, 0}, 275, 1, &Point64T{-2.125, 52.125}},
+		{"tests/dem.tif", 6, 5, 100, 110, PointT{5, 0}, 105, 1, &Point64T{1000, 2000}},
+		{"tests/dem-tiled.tif", 6, 5, 100.25, 110.25, PointT{5, 0}, 105, 1, nil},
+	}
+	for _, td := range testdata {
+		fmt.Printf("\t%s\n", td.infile)
+		hm, width, height, err := loadHeightMap(OptsT{infile: td.infile})
+		if err != nil {
+			t.Errorf("Can't load %s: %s\n", td.infile, err)
+			continue
+		}
+		if width != td.width || height != td.height || hm.low != td.low || hm.high != td.high {
+			t.Errorf("Wrong size or range for %s: wanted %dx%d %g..%g  got %dx%d %g..%g\n",
+				td.infile, td.width, td.height, td.low, td.high, width, height, hm.low, hm.high)
+		}
+		if !hm.noData(td.noData.x, td.noData.y) {
+			t.Errorf("Expected no data at %v in %s\n", td.noData, td.infile)
+		}
+		if td.topLeft == nil {
+			if hm.geo != nil {
+				t.Errorf("Unexpected georeference for %s: %v\n", td.infile, *hm.geo)
+			}
+		} else if hm.geo == nil || !hm.geo.toWorld(Point64T{0, 0}).Equal(*td.topLeft) {
+			t.Errorf("Wrong georeference for %s: wanted top left %v, got %v\n", td.infile, *td.topLeft, hm.geo)
+		}
+		contours, _ := contourFinder(hm, width, height, td.threshold)
+		if len(contours) != td.count {
+			t.Errorf("Wrong number of contours for %s: wanted %d got %d\n", td.infile, td.count, len(contours))
+		}
+	}
+	// Broken ASCII grids
+	asc, err := os.ReadFile("tests/grid.asc")
+	if err != nil {
+		t.Fatalf("Can't read tests/grid.asc: %s", err)
+	}
+	ascFile := filepath.Join(t.TempDir(), "broken.asc")
+	for _, broken := range []struct {
+		pattern, replacement string
+		wanted               string // in the error
+	}{
+		{`(?m)^xllcorner.*\n`, "", "missing xllcorner or xllcenter"},
+		{`ncols +6`, "ncols 6.5", "invalid grid size"},
+		{`nrows +5`, "nrows 1e12", "invalid grid size"},
+		{`\s*$`, " 110.5\n", "more than 30 values"},
+		{`\s*\S+\s*$`, "\n", "grid has 29 values"},
+	} {
+		data := regexp.MustCompile(broken.pattern).ReplaceAll(asc, []byte(broken.replacement))
+		if err := os.WriteFile(ascFile, data, 0644); err != nil {
+			t.Fatalf("Can't create %s: %s", ascFile, err)
+		}
+		if _, _, _, err := loadHeightMap(OptsT{infile: ascFile}); err == nil || !strings.Contains(err.Error(), broken.wanted) {
+			t.Errorf("Expected an error with '%s' for a broken grid, got %v\n", broken.wanted, err)
+		}
+	}
+}
+
+func TestMask(t *testing.T) {
+	fmt.Println("TestMask")
+	// White image with a black bar across it, cut in two by a transparent column
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			c := color.NRGBA{255, 255, 255, 255}
+			if y >= 1 && y <= 2 && x >= 1 && x <= 6 {
+				c = color.NRGBA{0, 0, 0, 255}
+			}
+			if x == 4 {
+				c.A = 0
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	// Mask image that hides the last column
+	maskImg := image.NewGray(image.Rect(0, 0, 8, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			if x < 6 {
+				maskImg.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+	dir := t.TempDir()
+	for _, f := range []struct {
+		name string
+		img  image.Image
+	}{{"bar.png", img}, {"mask.png", maskImg}} {
+		fh, err := os.Create(filepath.Join(dir, f.name))
+		if err != nil {
+			t.Fatalf("Can't create %s: %s", f.name, err)
+		}
+		png.Encode(fh, f.img)
+		fh.Close()
+	}
+	opts := OptsT{infile: filepath.Join(dir, "bar.png"), alphaCutoff: 0.5, thresholds: []float64{128}, tcount: -1, margin: 15, paper: "A4L", linewidth: 1}
+	hm, width, height, err := loadHeightMap(opts)
+	if err != nil {
+		t.Fatalf("Can't load %s: %s", opts.infile, err)
+	}
+	if !hm.noData(4, 0) || hm.noData(3, 0) || hm.noData(7, 0) {
+		t.Errorf("Wrong alpha mask\n")
+	}
+	contours, _ := contourFinder(hm, width, height, 128)
+	if len(contours) != 2 {
+		t.Errorf("Wrong number of contours with alpha mask: wanted 2 got %d\n", len(contours))
+	}
+	// The contours are broken where they meet the transparent column
+	parsePaperSize(&opts)
+	bytes, err := os.ReadFile(createOutput(opts))
+	if err != nil {
+		t.Fatalf("Can't read in the SVG file: %s", err)
+	}
+	if strings.Contains(string(bytes), "<polygon") || strings.Count(string(bytes), "<polyline") != 3 {
+		t.Errorf("Contours not broken at the mask:\n%s\n", bytes)
+	}
+	// With --clip, the loops are still filled, but they're not stroked along the transparent column
+	clipOpts := opts
+	clipOpts.clip = true
+	clipOpts.colours = "ff0000-0000ff"
+	bytes, err = os.ReadFile(createOutput(clipOpts))
+	if err != nil {
+		t.Fatalf("Can't read in the clipped SVG file: %s", err)
+	}
+	fills := regexp.MustCompile(`stroke="none" d="([^"]*)"`).FindStringSubmatch(string(bytes))
+	strokes := regexp.MustCompile(`fill="none" d="([^"]*)"`).FindStringSubmatch(string(bytes))
+	if fills == nil || strings.Count(fills[1], "Z") != 2 || strokes == nil || strings.Count(strokes[1], "M") != 3 || strings.Contains(strokes[1], "Z") ||
+		strings.Contains(strokes[1], "4.00,1.50 L 4.00,2.50") || strings.Contains(strokes[1], "5.00,2.50 L 5.00,1.50") {
+		t.Errorf("Clipped contours not filled whole and stroked in pieces at the mask:\n%s\n", bytes)
+	}
+	opts.mask = filepath.Join(dir, "mask.png")
+	hm, _, _, err = loadHeightMap(opts)
+	if err != nil {
+		t.Fatalf("Can't load %s with mask: %s", opts.infile, err)
+	}
+	if !hm.noData(4, 0) || hm.noData(3, 0) || !hm.noData(7, 0) {
+		t.Errorf("Wrong mask from image\n")
+	}
+}
+
+func TestChannels(t *testing.T) {
+	fmt.Println("TestChannels")
+	type testdataT struct {
+		channel string
+		wanted  float64
+	}
+	// All for the colour 200,100,50 with alpha 255
+	testdata := []testdataT{
+		{"r", 200},
+		{"g", 100},
+		{"B", 50},
+		{"alpha", 255},
+		{"luma601", 124.2},
+		{"luma709", 117.65},
+		{"value", 200},
+		{"saturation", 191.25},
+		{"hue", 14.167},
+		{"mix:1,1,2", 100},
+		{"mapbox", 1303285},
+		{"terrarium", 18532.1953125},
+	}
+	for _, td := range testdata {
+		ch, err := parseChannel(td.channel)
+		if err != nil {
+			t.Errorf("Can't parse channel '%s': %s\n", td.channel, err)
+			continue
+		}
+		got := ch.value(200, 100, 50, 255, 255)
+		if !almostEqual(got, td.wanted, 0.001) {
+			t.Errorf("Wrong value for channel '%s': wanted %g got %g\n", td.channel, td.wanted, got)
+		}
+	}
+	for _, bad := range []string{"foo", "r:1", "mix", "mix:1,2", "mix:0,0,0", "mix:a,b,c"} {
+		if _, err := parseChannel(bad); err == nil {
+			t.Errorf("Invalid channel '%s' accepted\n", bad)
+		}
+	}
+	// Terrain-RGB tile: 100m all round, with a 50m pit in the middle
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 3))
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{1, 138, 136, 255})
+		}
+	}
+	img.SetNRGBA(1, 1, color.NRGBA{1, 136, 148, 255})
+	filename := filepath.Join(t.TempDir(), "tile.png")
+	fh, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Can't create %s: %s", filename, err)
+	}
+	png.Encode(fh, img)
+	fh.Close()
+	hm, width, height, err := loadHeightMap(OptsT{infile: filename, channel: "mapbox"})
+	if err != nil {
+		t.Fatalf("Can't load %s: %s", filename, err)
+	}
+	if !almostEqual(hm.low, 50, 0.001) || !almostEqual(hm.high, 100, 0.001) || hm.integral {
+		t.Errorf("Wrong terrain-RGB range: wanted 50..100, got %g..%g\n", hm.low, hm.high)
+	}
+	if contours, _ := contourFinder(hm, width, height, 75); len(contours) != 1 {
+		t.Errorf("Wrong number of terrain-RGB contours: wanted 1 got %d\n", len(contours))
+	}
+
+	hm = newHeightMap(2, 1)
+	hm.high = 255
+	hm.values = []float64{55, math.NaN()}
+	hm.invert()
+	if hm.values[0] != 200 || !hm.noData(1, 0) {
+		t.Errorf("Wrong inverted values: %v\n", hm.values)
+	}
+}
+
+func TestIndexContours(t *testing.T) {
+	fmt.Println("TestIndexContours")
+	type testdataT struct {
+		opts   OptsT
+		wanted []bool // for each threshold
+	}
+	testdata := []testdataT{
+		{OptsT{thresholds: []float64{10, 20, 30, 40, 50}, indexEvery: 2}, []bool{false, true, false, true, false}},
+		{OptsT{thresholds: []float64{10, 20, 30, 40, 50}}, []bool{false, false, false, false, false}},
+		{OptsT{thresholds: []float64{10, 20, 30, 40, 50}, interval: 10, indexEvery: 5}, []bool{false, false, false, false, true}},
+		{OptsT{thresholds: []float64{15, 20, 25, 30}, interval: 5, base: 5, indexEvery: 2}, []bool{true, false, true, false}},
+	}
+	for _, td := range testdata {
+		styles := layerStyles(td.opts)
+		for i, want := range td.wanted {
+			if styles[i+1].index != want {
+				t.Errorf("Wrong index flag for %g with %v: wanted %t\n", td.opts.thresholds[i], td.opts, want)
+			}
+		}
+		if styles[0].index {
+			t.Errorf("Background marked as an index layer\n")
+		}
+	}
+
+	opts := OptsT{thresholds: []float64{85, 171}, indexEvery: 2, indexColour: "7f3f00", linewidth: 1}
+	styles := layerStyles(opts)
+	if styles[2].width != 2 || styles[2].colour != "7f3f00" || styles[1].width != 0 {
+		t.Errorf("Wrong index styles: %v\n", styles)
+	}
+	// Check the layer's attributes in the SVG
+	svgFilename := filepath.Join(t.TempDir(), "index.svg")
+	svgF := SVGfile{currentLayer: -1}
+	svgF.open(svgFilename)
+	svgF.thresholds = append([]float64{0}, opts.thresholds...)
+	svgF.styles = styles
+	svgF.scale = 20
+	svgF.layer(2, "index", 1)
+	svgF.layer(1, "contour", 0)
+	svgF.endLayer()
+	svgF.stopSave()
+	bytes, err := os.ReadFile(svgFilename)
+	if err != nil {
+		t.Fatalf("Can't read in the SVG file: %s", err)
+	}
+	wanted := "<g inkscape:groupmode=\"layer\" inkscape:label=\"171 index\" stroke=\"#7f3f00\" stroke-width=\"0.1000\" >\n</g>\n" +
+		"<g inkscape:groupmode=\"layer\" inkscape:label=\"85 contour\" stroke=\"black\"  >\n</g>\n"
+	if !strings.Contains(string(bytes), wanted) {
+		t.Errorf("Wrong index layers:\n\twanted '%s'\n\t   got '%s'\n", wanted, string(bytes))
+	}
+}
+
+func TestStrokeStyles(t *testing.T) {
+	fmt.Println("TestStrokeStyles")
+	styles, err := parseStrokeStyles("FF0000,width=0.3; -;colour=0000ff, dash=2/1, opacity=0.5")
+	if err != nil {
+		t.Fatalf("Can't parse styles: %s", err)
+	}
+	if len(styles) != 3 || styles[0].colour != "ff0000" || styles[0].width != 0.3 ||
+		styles[1].colour != "" || styles[2].colour != "0000ff" || len(styles[2].dash) != 2 || styles[2].opacity != 0.5 {
+		t.Errorf("Wrong styles: %v\n", styles)
+	}
+	for _, bad := range []string{"f00", "width=0", "width=x", "dash=", "dash=1/-1", "opacity=2", "pen=3"} {
+		if _, err := parseStrokeStyles(bad); err == nil {
+			t.Errorf("Invalid style '%s' accepted\n", bad)
+		}
+	}
+	filename := filepath.Join(t.TempDir(), "styles.txt")
+	os.WriteFile(filename, []byte("# pens\nff0000\n\n00ff00,width=0.7\n"), 0644)
+	fileStyles, err := loadStrokeStyles(filename)
+	if err != nil || len(fileStyles) != 2 || fileStyles[1].width != 0.7 {
+		t.Errorf("Wrong styles from file: %v %v\n", fileStyles, err)
+	}
+
+	// Styles are used in turn, and take precedence over index contours
+	opts := OptsT{thresholds: []float64{10, 20, 30}, indexEvery: 3, linewidth: 0.5, strokeStyles: fileStyles}
+	got := layerStyles(opts)
+	if got[1].colour != "ff0000" || got[2].colour != "00ff00" || got[3].colour != "ff0000" ||
+		got[3].width != 1 || !got[3].index || got[2].width != 0.7 {
+		t.Errorf("Wrong layer styles: %v\n", got)
+	}
+
+	svgFilename := filepath.Join(t.TempDir(), "styles.svg")
+	svgF := SVGfile{currentLayer: -1}
+	svgF.open(svgFilename)
+	svgF.thresholds = []float64{0, 128}
+	svgF.styles = []StrokeStyleT{{}, styles[2]}
+	svgF.scale = 10
+	svgF.layer(1, "contour", 0)
+	svgF.stopSave()
+	bytes, err := os.ReadFile(svgFilename)
+	if err != nil {
+		t.Fatalf("Can't read in the SVG file: %s", err)
+	}
+	wanted := "<g inkscape:groupmode=\"layer\" inkscape:label=\"128 contour\" stroke=\"#0000ff\" stroke-dasharray=\"0.2000 0.1000\" stroke-opacity=\"0.5\" >\n"
+	if !strings.Contains(string(bytes), wanted) {
+		t.Errorf("Wrong styled layer:\n\twanted '%s'\n\t   got '%s'\n", wanted, string(bytes))
+	}
+}
+
+// Copy an image from tests/ into a temporary directory, so that the files
+// made from it go there too.  Returns the copy's path.
+func copyTestImage(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("tests", name))
+	if err != nil {
+		t.Fatalf("Can't read tests/%s: %s", name, err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Can't write %s: %s", path, err)
+	}
+	return path
+}
+
+func TestGcode(t *testing.T) {
+	fmt.Println("TestGcode")
+	infile := copyTestImage(t, "test3.png")
+	opts := OptsT{infile: infile, thresholds: []float64{128}, tcount: -1, margin: 15, framewidth: 2, paper: "A4L", linewidth: 1,
+		format: "gcode", gcodePen: "servo", penUp: 50, penDown: 30, feedRate: 1200, gcodeOrigin: "bottom-left"}
+	parsePaperSize(&opts)
+	filename := createOutput(opts)
+	if !strings.HasSuffix(filename, "-hc-t128m15pA4LF2.gcode") {
+		t.Errorf("Wrong G-code filename '%s'\n", filename)
+	}
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Can't read in the G-code file: %s", err)
+	}
+	got := string(bytes)
+	// As in the SVG: the image is scaled by 22 and moved to 60.5,17, so the
+	// first contour starts at 0.998,0.50 -> 82.457,28 -> 82.457,182 with Y up the page
+	for _, wanted := range []string{
+		"G21 ; millimetres\nG90 ; absolute coordinates\n",
+		"; frame\nG0 X59.500 Y194.000\nM3 S30\nG1 X237.500 Y194.000 F1200\n",
+		"; layer 128 contour\nG0 X82.457 Y182.000\nM3 S30\nG1 X93.478 Y193.000 F1200\nM3 S50\n",
+		"; Total contour length: 1.00m\nG0 X0 Y0\nM2\n",
+	} {
+		if !strings.Contains(got, wanted) {
+			t.Errorf("G-code doesn't contain '%s':\n%s\n", wanted, got)
+		}
+	}
+	// 1 frame, 5 polylines, and 1 polygon
+	if count := strings.Count(got, "M3 S30"); count != 7 {
+		t.Errorf("Wrong number of pen downs: wanted 7 got %d\n", count)
+	}
+
+	gc := GcodeFile{opts: opts}
+	for _, td := range []struct {
+		origin string
+		wanted Point64T
+	}{{"bottom-left", Point64T{10, 190}}, {"top-left", Point64T{10, -20}}, {"centre", Point64T{-138.5, 85}}} {
+		gc.opts.gcodeOrigin = td.origin
+		if got := gc.toMachine(Point64T{10, 20}); !got.Equal(td.wanted) {
+			t.Errorf("Wrong machine coordinates for origin %s: wanted %v got %v\n", td.origin, td.wanted, got)
+		}
+	}
+}
+
+func TestHPGL(t *testing.T) {
+	fmt.Println("TestHPGL")
+	infile := copyTestImage(t, "test4.png")
+	opts := OptsT{infile: infile, thresholds: []float64{100, 200}, tcount: -1, margin: 15, framewidth: 1, paper: "A4P", linewidth: 1,
+		format: "hpgl", pens: []int{3, 5}}
+	parsePaperSize(&opts)
+	filename := createOutput(opts)
+	if !strings.HasSuffix(filename, "-hc-t100,200m15pA4PF1.hpgl") {
+		t.Errorf("Wrong HPGL filename '%s'\n", filename)
+	}
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Can't read in the HPGL file: %s", err)
+	}
+	got := string(bytes)
+	// Frame with the first pen; then 200 with the second pen, and 100 with the first
+	// 210mm wide paper, 297mm high, 15mm margin, 1mm frame: the image is 178mm wide, from 16mm,
+	// and 118.67mm high, from 89.17mm down, so the frame is 15.5..194.5mm across and 88.67..208.33mm down
+	for _, wanted := range []string{
+		"IN;\nSP3;\nPU620,8333;\nPD7780,8333,7780,3547,620,3547,620,8333;\nPU;\nSP5;\n",
+		"SP3;\n",
+		"PU;\nSP0;\n",
+	} {
+		if !strings.Contains(got, wanted) {
+			t.Errorf("HPGL doesn't contain '%s':\n%s\n", wanted, got)
+		}
+	}
+	if strings.Index(got, "SP5;") > strings.LastIndex(got, "SP3;") {
+		t.Errorf("Wrong pen order:\n%s\n", got)
+	}
+}
+
+func TestDXF(t *testing.T) {
+	fmt.Println("TestDXF")
+	if name := dxfLayerName(-12.5, "index"); name != "INDEX_-12_5" {
+		t.Errorf("Wrong DXF layer name: wanted 'INDEX_-12_5' got '%s'\n", name)
+	}
+	infile := copyTestImage(t, "test3.png")
+	opts := OptsT{infile: infile, thresholds: []float64{128}, tcount: -1, margin: 15, paper: "A4L", linewidth: 1, format: "dxf"}
+	parsePaperSize(&opts)
+	filename := createOutput(opts)
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Can't read in the DXF file: %s", err)
+	}
+	got := string(bytes)
+	if !strings.HasPrefix(got, "999\n") || !strings.HasSuffix(got, "  0\nENDSEC\n  0\nEOF\n") {
+		t.Errorf("DXF file doesn't start and end properly:\n%s\n", got)
+	}
+	if !strings.Contains(got, "  0\nLTYPE\n  2\nCONTINUOUS\n") || strings.Contains(got, "$INSUNITS") {
+		t.Errorf("DXF file doesn't define linetype CONTINUOUS, or has $INSUNITS, which R12 doesn't:\n%s\n", got)
+	}
+	if !strings.Contains(got, "  0\nLAYER\n  2\nCONTOUR_128\n 70\n0\n 62\n2\n") {
+		t.Errorf("DXF file doesn't have layer CONTOUR_128:\n%s\n", got)
+	}
+	// 5 open polylines and 1 closed polygon, as in the SVG
+	polylines := strings.Split(got, "  0\nPOLYLINE\n")[1:]
+	closed := 0
+	for _, pl := range polylines {
+		if strings.Contains(pl, " 70\n1\n  0\nVERTEX") {
+			closed++
+		}
+	}
+	if len(polylines) != 6 || closed != 1 {
+		t.Errorf("Wrong DXF polylines: wanted 6 with 1 closed, got %d with %d closed\n", len(polylines), closed)
+	}
+	// First point of the first contour: 0.998,0.50 in the image, scaled by 22.5 and moved
+	// to 58.5,15 -> 80.956,26.25 on the paper -> 80.956,183.75 with Y up
+	if !strings.Contains(got, "  0\nVERTEX\n  8\nCONTOUR_128\n 10\n80.9559\n 20\n183.7500\n") {
+		t.Errorf("DXF file doesn't have the first vertex in the right place:\n%s\n", got)
+	}
+}
+
+func TestGeoJSON(t *testing.T) {
+	fmt.Println("TestGeoJSON")
+	infile := copyTestImage(t, "test3.png")
+	dir := filepath.Dir(infile)
+	type featureT struct {
+		Geometry struct {
+			Type        string
+			Coordinates json.RawMessage
+		}
+		Properties struct {
+			Threshold float64
+			Area      *float64
+			Clipped   bool
+		}
+	}
+	type collectionT struct {
+		Type     string
+		Features []featureT
+		Comments []string
+	}
+	read := func(opts OptsT) collectionT {
+		parsePaperSize(&opts)
+		filename := createOutput(opts)
+		bytes, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Can't read in the GeoJSON file: %s", err)
+		}
+		var fc collectionT
+		if err := json.Unmarshal(bytes, &fc); err != nil {
+			t.Fatalf("Invalid GeoJSON: %s\n%s", err, bytes)
+		}
+		return fc
+	}
+	opts := OptsT{infile: infile, thresholds: []float64{128}, tcount: -1, margin: 15, paper: "A4L", linewidth: 1, format: "geojson"}
+
+	// In pixels: 5 lines broken at the edge, and 1 polygon, as in the SVG
+	fc := read(opts)
+	if fc.Type != "FeatureCollection" || len(fc.Features) != 6 || len(fc.Comments) < 3 {
+		t.Fatalf("Wrong GeoJSON: %+v\n", fc)
+	}
+	for i, f := range fc.Features {
+		polygon := i == 5
+		if (f.Geometry.Type == "Polygon") != polygon || f.Properties.Clipped == polygon || (f.Properties.Area != nil) != polygon || f.Properties.Threshold != 128 {
+			t.Errorf("Wrong feature %d: %+v\n", i, f)
+		}
+	}
+	var rings [][][2]float64
+	json.Unmarshal(fc.Features[5].Geometry.Coordinates, &rings)
+	ring := make(ContourT, len(rings[0]))
+	for i, p := range rings[0] {
+		ring[i] = Point64T{p[0], p[1]}
+	}
+	if ring.SignedArea() <= 0 || !almostEqual(*fc.Features[5].Properties.Area, ring.SignedArea(), 0.001) {
+		t.Errorf("Polygon goes the wrong way round, or has the wrong area: %v %g\n", ring, *fc.Features[5].Properties.Area)
+	}
+
+	// With a world file: 10m pixels, top-left corner at 1000,2100
+	os.WriteFile(filepath.Join(dir, "test3.pgw"), []byte("10\n0\n0\n-10\n1005\n2095\n"), 0644)
+	geo, err := loadWorldFile(infile)
+	if err != nil || geo == nil || *geo != (GeoRefT{a: 10, e: -10, c: 1000, f: 2100}) {
+		t.Fatalf("Wrong world file: %v %v\n", geo, err)
+	}
+	fc = read(opts)
+	var line [][2]float64
+	json.Unmarshal(fc.Features[0].Geometry.Coordinates, &line)
+	// first point: 0.998,0.5 in pixels
+	if len(line) == 0 || !almostEqual(line[0][0], 1009.98, 0.01) || !almostEqual(line[0][1], 2095, 0.01) {
+		t.Errorf("Wrong real-world coordinates: %v\n", line)
+	}
+	if !strings.HasPrefix(fc.Comments[2], "Georeference: top left 1000,2100") {
+		t.Errorf("Missing georeference: %v\n", fc.Comments)
+	}
+}
+
+func TestPDF(t *testing.T) {
+	fmt.Println("TestPDF")
+	infile := copyTestImage(t, "test7.png")
+	opts := OptsT{infile: infile, thresholds: []float64{85, 171}, tcount: -1, margin: 15, paper: "A4L", clip: true, linewidth: 1,
+		colours: "ff7700-0077ff", format: "pdf", strokeStyles: []StrokeStyleT{{opacity: 0.5}}}
+	parsePaperSize(&opts)
+	filename := createOutput(opts)
+	got, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Can't read in the PDF file: %s", err)
+	}
+	if !bytes.HasPrefix(got, []byte("%PDF-1.5\n")) || !bytes.HasSuffix(got, []byte("%%EOF\n")) {
+		t.Fatalf("PDF file doesn't start and end properly")
+	}
+	// Check that the cross-reference table points at the objects
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(got)
+	xref, _ := strconv.Atoi(string(m[1]))
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(got[xref:], -1)
+	if len(entries) < 7 {
+		t.Errorf("Too few objects in PDF: %d\n", len(entries))
+	}
+	for i, e := range entries {
+		offset, _ := strconv.Atoi(string(e[1]))
+		if !bytes.HasPrefix(got[offset:], []byte(fmt.Sprintf("%d 0 obj\n", i+1))) {
+			t.Errorf("Wrong offset for object %d: %d\n", i+1, offset)
+		}
+	}
+	for _, wanted := range []string{"/MediaBox [0 0 841.8898 595.2756]", "/Name (0 background)", "/Name (171 contour)", "/Name (85 contour)", "/CA 0.5"} {
+		if !bytes.Contains(got, []byte(wanted)) {
+			t.Errorf("PDF doesn't contain '%s'\n", wanted)
+		}
+	}
+	// The page's content: layers in optional content groups, filled and clipped
+	m = regexp.MustCompile(`(?s)4 0 obj\n<< /Filter /FlateDecode /Length (\d+) >>\nstream\n`).FindSubmatch(got)
+	if m == nil {
+		t.Fatalf("Can't find the PDF's content")
+	}
+	length, _ := strconv.Atoi(string(m[1]))
+	start := bytes.Index(got, m[0]) + len(m[0])
+	zr, err := zlib.NewReader(bytes.NewReader(got[start : start+length]))
+	if err != nil {
+		t.Fatalf("Can't decompress the PDF's content: %s", err)
+	}
+	content, _ := io.ReadAll(zr)
+	for _, wanted := range []string{
+		"2.834646 0 0 -2.834646 0 595.2756 cm\n25.7143 0 0 25.7143 84.2143 15.0000 cm\n",
+		"/OC /OC1 BDC\nq\n0.000 0.467 1.000 rg\n0 0 5 7 re f\nQ\nEMC\n",
+		"/OC /OC2 BDC\nq\n0.498 0.467 0.502 rg\n/GS1 gs\n0.0194 0.0194 4.9611 6.9611 re W n\n0.83 1.50 m 1.50 0.83 l ",
+		"h\nB\nQ\nEMC\n% 1 contours found at threshold 85",
+	} {
+		if !bytes.Contains(content, []byte(wanted)) {
+			t.Errorf("PDF content doesn't contain '%s':\n%s\n", wanted, content)
+		}
+	}
+}
+
+func TestPreview(t *testing.T) {
+	fmt.Println("TestPreview")
+	infile := copyTestImage(t, "test7.png")
+	dir := filepath.Dir(infile)
+	opts := OptsT{infile: infile, thresholds: []float64{85, 171}, tcount: -1, margin: 15, paper: "A4L", clip: true, linewidth: 1,
+		colours: "ff7700-0077ff", preview: filepath.Join(dir, "preview.png"), previewDPI: 50}
+	parsePaperSize(&opts)
+	createOutput(opts)
+	img, err := decodeImage(opts.preview)
+	if err != nil {
+		t.Fatalf("Can't read the preview: %s", err)
+	}
+	if img.Bounds().Dx() != 585 || img.Bounds().Dy() != 413 {
+		t.Errorf("Preview is %d x %d, wanted 585 x 413\n", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+	// Colours at points in the 5 x 7 input image
+	opts.width, opts.height = 5, 7
+	placement := newPlacement(opts)
+	pxPerMM := opts.previewDPI / 25.4
+	tests := []struct {
+		x, y   float64
+		wanted color.NRGBA
+	}{
+		{-1, 3.5, color.NRGBA{0xff, 0xff, 0xff, 0xff}},   // paper
+		{0.3, 0.3, color.NRGBA{0x00, 0x77, 0xff, 0xff}},  // background fill
+		{2.5, 1.0, color.NRGBA{0x7f, 0x77, 0x80, 0xff}},  // between the contours
+		{2.5, 1.4, color.NRGBA{0xff, 0x77, 0x00, 0xff}},  // inside both
+		{2.5, 1.17, color.NRGBA{0x00, 0x00, 0x00, 0xff}}, // on a contour
+	}
+	for _, test := range tests {
+		p := placement.toPaper(Point64T{test.x, test.y})
+		got := color.NRGBAModel.Convert(img.At(int(p.x*pxPerMM), int(p.y*pxPerMM))).(color.NRGBA)
+		if got != test.wanted {
+			t.Errorf("Preview at %g,%g is %v, wanted %v\n", test.x, test.y, got, test.wanted)
+		}
+	}
+	// Dashes
+	dashes := dashPath(ContourT{{0, 0}, {10, 0}}, []float64{3, 1})
+	if len(dashes) != 3 || dashes[2][0].x != 8 || dashes[2][1].x != 10 {
+		t.Errorf("dashPath gave %v\n", dashes)
+	}
+}
+
+func TestOrderPaths(t *testing.T) {
+	fmt.Println("TestOrderPaths")
+	paths := ContourS{
+		{{10, 0}, {11, 0}},
+		{{3, 0}, {2, 0}},
+		{{0, 0}, {1, 0}},
+		{{6, 5}, {6, 6}, {5, 6}, {5, 5}, {6, 5}},
+	}
+	tests := []struct {
+		reverse bool
+		wanted  ContourS
+		dist    float64
+	}{
+		{true, ContourS{{{0, 0}, {1, 0}}, {{2, 0}, {3, 0}}, {{6, 5}, {6, 6}, {5, 6}, {5, 5}, {6, 5}}, {{10, 0}, {11, 0}}}, 1 + math.Hypot(3, 5) + math.Hypot(4, 5)},
+		{false, ContourS{{{0, 0}, {1, 0}}, {{3, 0}, {2, 0}}, {{6, 5}, {6, 6}, {5, 6}, {5, 5}, {6, 5}}, {{10, 0}, {11, 0}}}, 2 + math.Hypot(4, 5) + math.Hypot(4, 5)},
+	}
+	// The square starts at the corner that's nearest to both the paths either side of it
+	before, _ := penUpDistance(paths, Point64T{0, 0})
+	for _, test := range tests {
+		got := orderPaths(paths, Point64T{0, 0}, test.reverse)
+		if len(got) != len(test.wanted) {
+			t.Fatalf("orderPaths (reverse %t) gave %v, wanted %v\n", test.reverse, got, test.wanted)
+		}
+		for i := range got {
+			if !got[i].Equal(test.wanted[i]) {
+				t.Errorf("orderPaths (reverse %t) gave %v, wanted %v\n", test.reverse, got, test.wanted)
+				break
+			}
+		}
+		if dist, _ := penUpDistance(got, Point64T{0, 0}); math.Abs(dist-test.dist) > 0.001 || dist >= before {
+			t.Errorf("Pen-up distance (reverse %t) is %.3f (from %.3f), wanted %.3f\n", test.reverse, dist, before, test.dist)
+		}
+	}
+	// The paths that were given are left alone
+	if !paths[1].Equal(ContourT{{3, 0}, {2, 0}}) {
+		t.Errorf("orderPaths changed its input: %v\n", paths)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	fmt.Println("TestJoin")
+	img, width, height, err := loadImage("tests/test3.png")
+	if err != nil {
+		t.Fatalf("Input file tests/test3.png not found\n")
+	}
+	tests := []struct {
+		join, joinFrame bool
+		wanted          ContourS
+	}{
+		{false, false, ContourS{
+			{{1, 0.5}, {1.5, 0}}, {{2.5, 0}, {3, 0.5}, {3, 1.5}, {1.5, 3}, {0.5, 3}, {0, 2.5}}, {{0, 1.5}, {1, 0.5}},
+			{{4, 0.5}, {4.5, 0}}, {{0, 4.5}, {0.5, 4}, {2.5, 4}, {4, 2.5}, {4, 0.5}},
+			{{5, 4.5}, {5.5, 4}, {6, 4.5}, {6, 5.5}, {5.5, 6}, {4.5, 6}, {4, 5.5}, {5, 4.5}},
+		}},
+		{true, false, ContourS{
+			{{2.5, 0}, {3, 0.5}, {3, 1.5}, {1.5, 3}, {0.5, 3}, {0, 2.5}}, {{0, 1.5}, {1.5, 0}},
+			{{0, 4.5}, {0.5, 4}, {2.5, 4}, {4, 2.5}, {4, 0.5}, {4.5, 0}},
+			{{5, 4.5}, {5.5, 4}, {6, 4.5}, {6, 5.5}, {5.5, 6}, {4.5, 6}, {4, 5.5}, {5, 4.5}},
+		}},
+		{true, true, ContourS{
+			{{1, 0.5}, {1.5, 0}, {2.5, 0}, {3, 0.5}, {3, 1.5}, {1.5, 3}, {0.5, 3}, {0, 2.5}, {0, 1.5}, {1, 0.5}},
+			{{4, 0.5}, {4.5, 0}, {8, 0}, {8, 8}, {0, 8}, {0, 4.5}, {0.5, 4}, {2.5, 4}, {4, 2.5}, {4, 0.5}},
+			{{5, 4.5}, {5.5, 4}, {6, 4.5}, {6, 5.5}, {5.5, 6}, {4.5, 6}, {4, 5.5}, {5, 4.5}},
+		}},
+	}
+	for _, test := range tests {
+		layer := LayerT{}
+		layer.contours, _ = contourFinder(img, width, height, 128)
+		layer.makePaths(img, OptsT{join: test.join, joinFrame: test.joinFrame})
+		if len(layer.paths) != len(test.wanted) {
+			t.Errorf("Join %t, along frame %t: wanted %d paths, got %d: %v\n", test.join, test.joinFrame, len(test.wanted), len(layer.paths), layer.paths)
+			continue
+		}
+		for i, path := range layer.paths {
+			same := len(path) == len(test.wanted[i])
+			for j := 0; same && j < len(path); j++ {
+				same = path[j].Distance(test.wanted[i][j]) < 0.01
+			}
+			if !same {
+				t.Errorf("Join %t, along frame %t, path %d:\n\twanted=%v\n\t   got %v\n", test.join, test.joinFrame, i, test.wanted[i], path)
+			}
+		}
+	}
+	// Going round the edge of the image
+	for _, p := range []Point64T{{0, 0}, {3, 0}, {8, 2}, {8, 6}, {5, 6}, {0, 6}, {0, 1}} {
+		if got := edgePosition(edgeDistance(p, 8, 6), 8, 6); !got.Equal(p) {
+			t.Errorf("Edge position of %v came back as %v\n", p, got)
+		}
+	}
+}
+
+func TestClip(t *testing.T) {
+	fmt.Println("TestClip")
+	box := [4]float64{0, 0, 4, 3}
+	segments := []struct {
+		a, b   Point64T
+		wanted ContourT // nil if it's all outside
+	}{
+		{Point64T{1, 1}, Point64T{2, 2}, ContourT{{1, 1}, {2, 2}}},
+		{Point64T{-1, 1}, Point64T{2, 1}, ContourT{{0, 1}, {2, 1}}},
+		{Point64T{-0.5, 1}, Point64T{1, -0.5}, ContourT{{0, 0.5}, {0.5, 0}}}, // across a corner
+		{Point64T{-1, 0.5}, Point64T{0.5, -1}, nil},                          // round a corner
+		{Point64T{5, 1}, Point64T{5, 2}, nil},
+		{Point64T{2, -1}, Point64T{2, 5}, ContourT{{2, 0}, {2, 3}}},
+	}
+	for _, s := range segments {
+		a, b, ok := clipSegment(s.a, s.b, box)
+		if ok != (s.wanted != nil) || (ok && !(ContourT{a, b}).Equal(s.wanted)) {
+			t.Errorf("clipSegment %v to %v: wanted %v, got %v %v %t\n", s.a, s.b, s.wanted, a, b, ok)
+		}
+	}
+	polygons := []struct {
+		poly, wanted ContourT
+	}{
+		{ContourT{{1, 1}, {2, 1}, {2, 2}, {1, 1}}, ContourT{{1, 1}, {2, 1}, {2, 2}, {1, 1}}},
+		{ContourT{{-1, -1}, {5, -1}, {5, 4}, {-1, 4}, {-1, -1}}, ContourT{{0, 3}, {0, 0}, {4, 0}, {4, 3}, {0, 3}}},
+		{ContourT{{3, 1}, {5, 1}, {5, 2}, {3, 2}, {3, 1}}, ContourT{{3, 1}, {4, 1}, {4, 2}, {3, 2}, {3, 1}}},
+		{ContourT{{-1, 1}, {2, -1}, {2, 2}, {-1, 1}}, ContourT{{0, 1.3333}, {0, 0.3333}, {0.5, 0}, {2, 0}, {2, 2}, {0, 1.3333}}}, // across a corner
+		{ContourT{{5, 1}, {6, 1}, {6, 2}, {5, 1}}, nil},
+	}
+	for _, p := range polygons {
+		if got := clipPolygon(p.poly, box); !got.Equal(p.wanted) {
+			t.Errorf("clipPolygon %v: wanted %v, got %v\n", p.poly, p.wanted, got)
+		}
+	}
+	// test11.png has high corners, so the contour cuts across all four of them,
+	// and each piece ends where it crosses the edge.  (Where a corner is low, as
+	// in test3.png, the contour only goes round the padding outside the image,
+	// so there's nothing to plot there: see TestCreateSVG.)
+	img, width, height, err := loadImage("tests/test11.png")
+	if err != nil {
+		t.Fatalf("Input file tests/test11.png not found\n")
+	}
+	contours, _ := contourFinder(img, width, height, 128)
+	if len(contours) != 1 {
+		t.Fatalf("Wrong number of contours in test11.png: wanted 1 got %d\n", len(contours))
+	}
+	wanted := ContourS{
+		{{1, 0.5}, {1.5, 0}},
+		{{2.5, 0}, {3, 0.5}, {3.5, 1}, {4, 1.5}},
+		{{4, 2.5}, {3.5, 3}, {3, 3.5}, {2.5, 4}},
+		{{1.5, 4}, {1, 3.5}, {0.5, 3}, {0, 2.5}},
+		{{0, 1.5}, {0.5, 1}, {1, 0.5}},
+	}
+	got := splitContour(contours[0], img)
+	if len(got) != len(wanted) {
+		t.Fatalf("splitContour: wanted %v, got %v\n", wanted, got)
+	}
+	for i := range got {
+		if len(got[i]) != len(wanted[i]) {
+			t.Errorf("splitContour: wanted %v, got %v\n", wanted, got)
+			continue
+		}
+		for j := range got[i] {
+			if got[i][j].Distance(wanted[i][j]) > 0.01 {
+				t.Errorf("splitContour: wanted %v, got %v\n", wanted, got)
+			}
+		}
+	}
+	hm := newHeightMap(4, 3)
+	// Contours are clipped to the image whatever the format, even for SVG, which has a clip path as well
+	layer := LayerT{contours: ContourS{{{-1, 1}, {2, -1}, {2, 2}, {-1, 1}}}}
+	opts := OptsT{width: 4, height: 3, margin: 15, paperSize: RectangleT{297, 210}, clip: true, format: "svg"}
+	layer.makePaths(hm, opts)
+	if len(layer.paths) != 1 {
+		t.Fatalf("Clipped paths: wanted 1, got %v\n", layer.paths)
+	}
+	for _, p := range layer.paths[0] {
+		if !inBox(p, imageBox(4, 3)) {
+			t.Errorf("Clipped path goes off the image: %v\n", layer.paths)
+		}
+	}
+	// An inset of more than half the image leaves nothing to plot
+	for _, inset := range []float64{2, 200} {
+		opts.clipInset = inset
+		if err := checkClipBox(opts); (err != nil) != (inset > 100) {
+			t.Errorf("Wrong check of clip inset %g: %v\n", inset, err)
+		}
+	}
+
+	// Filled SVG with the contours clipped, inset by half the line width and 2mm
+	infile := copyTestImage(t, "test4.png")
+	opts = OptsT{infile: infile, thresholds: []float64{100, 200}, tcount: -1, margin: 15, paper: "A4P", clip: true, clipGeometry: true, clipInset: 2,
+		linewidth: 1, colours: "ff7700-0077ff"}
+	parsePaperSize(&opts)
+	bytes, err := os.ReadFile(createOutput(opts))
+	if err != nil {
+		t.Fatalf("Can't read in the SVG file: %s", err)
+	}
+	svgText := string(bytes)
+	if strings.Contains(svgText, "clip-path") || strings.Contains(svgText, "clipPath") {
+		t.Errorf("SVG has a clip path:\n%s\n", svgText)
+	}
+	// The scale is 30, so the inset is 2.5mm = 0.0833 pixels
+	inset := 2.5 / 30
+	points := regexp.MustCompile(`([-\d.]+),([-\d.]+) `).FindAllStringSubmatch(svgText, -1)
+	if len(points) < 20 {
+		t.Errorf("Not enough points in the SVG:\n%s\n", svgText)
+	}
+	for _, m := range points {
+		x, _ := strconv.ParseFloat(m[1], 64)
+		y, _ := strconv.ParseFloat(m[2], 64)
+		if x < inset-0.005 || y < inset-0.005 || x > 6-inset+0.005 || y > 4-inset+0.005 {
+			t.Errorf("Point %g,%g is outside the clipping rectangle\n", x, y)
+		}
+	}
+	if !strings.Contains(svgText, "<rect id=\"plotsize\" width=\"5.8333\" height=\"3.8333\" x=\"0.0833\" y=\"0.0833\" stroke=\"none\" />") {
+		t.Errorf("SVG's background isn't clipped:\n%s\n", svgText)
+	}
+}
+
+func TestSmooth(t *testing.T) {
+	fmt.Println("TestSmooth")
+	box := imageBox(10, 10)
+	tests := []struct {
+		path, wanted ContourT
+	}{
+		// closed, away from the edge: every corner is cut
+		{ContourT{{2, 2}, {6, 2}, {6, 6}, {2, 6}, {2, 2}},
+			ContourT{{2, 3}, {3, 2}, {5, 2}, {6, 3}, {6, 5}, {5, 6}, {3, 6}, {2, 5}, {2, 3}}},
+		// closed, with a side on the edge: those corners stay put
+		{ContourT{{0, 2}, {4, 2}, {4, 6}, {0, 6}, {0, 2}},
+			ContourT{{0, 2}, {3, 2}, {4, 3}, {4, 5}, {3, 6}, {0, 6}, {0, 2}}},
+		// open: the ends stay put
+		{ContourT{{1, 1}, {3, 3}, {5, 1}},
+			ContourT{{1, 1}, {2.5, 2.5}, {3.5, 2.5}, {5, 1}}},
+	}
+	for _, test := range tests {
+		if got := chaikin(test.path, box); !got.Equal(test.wanted) {
+			t.Errorf("Chaikin %v:\n\twanted=%v\n\t   got %v\n", test.path, test.wanted, got)
+		}
+	}
+	// Curves go through the points, and stay on the edge between points on it
+	path := tests[1].path
+	curves := catmullRom(path, box)
+	if len(curves) != len(path)-1 {
+		t.Errorf("Wanted %d curves, got %d\n", len(path)-1, len(curves))
+	}
+	if edge := curves[len(curves)-1]; edge.c1.x != 0 || edge.c2.x != 0 || !edge.p.Equal(path[0]) {
+		t.Errorf("Curve along the edge has left it: %v\n", edge)
+	}
+	flat := flattenCurve(path, box)
+	if len(flat) != (len(path)-1)*curveSteps+1 || !flat.IsClosed() {
+		t.Errorf("Flattened curve isn't closed, or has the wrong number of points: %v\n", flat)
+	}
+	for _, p := range flat[len(flat)-curveSteps:] {
+		if p.x != 0 {
+			t.Errorf("Flattened curve along the edge has left it at %v\n", p)
+		}
+	}
+
+	// SVG draws curves
+	infile := copyTestImage(t, "test3.png")
+	opts := OptsT{infile: infile, thresholds: []float64{128}, tcount: -1, margin: 15, paper: "A4L", linewidth: 0.5, smooth: "curve"}
+	parsePaperSize(&opts)
+	bytes, err := os.ReadFile(createOutput(opts))
+	if err != nil {
+		t.Fatalf("Can't read in the SVG file: %s", err)
+	}
+	svgText := string(bytes)
+	if strings.Contains(svgText, "<polyline") || strings.Contains(svgText, "<polygon") || !strings.Contains(svgText, " C ") {
+		t.Errorf("SVG doesn't have curves:\n%s\n", svgText)
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	fmt.Println("TestSimplify")
+	box := imageBox(100, 100)
+	noisy := ContourT{{10, 10}, {15, 10.1}, {20, 10}, {20, 20}, {10, 20}, {10, 10}}
+	tiny := ContourT{{10, 10}, {11, 10}, {11, 11}, {10, 11}, {10, 10}}
+	tests := []struct {
+		path      ContourT
+		tolerance float64
+		wanted    ContourT
+	}{
+		{ContourT{{10, 10}, {11, 10.1}, {12, 10}, {13, 11}, {14, 10}}, 0.5, ContourT{{10, 10}, {12, 10}, {13, 11}, {14, 10}}},
+		{noisy, 0.5, ContourT{{10, 10}, {20, 10}, {20, 20}, {10, 20}, {10, 10}}},
+		{tiny, 5, ContourT{{10, 10}, {11, 10}, {11, 11}, {10, 10}}},
+		// the corners on the edge stay, however close they are
+		{ContourT{{0, 10}, {50, 10}, {50.1, 10.1}, {100, 10}, {100, 15}, {0, 15}, {0, 10}}, 5, ContourT{{0, 10}, {100, 10}, {100, 15}, {0, 15}, {0, 10}}},
+	}
+	for _, test := range tests {
+		if got := douglasPeucker(test.path, test.tolerance, box); !got.Equal(test.wanted) {
+			t.Errorf("Douglas-Peucker %v, tolerance %g:\n\twanted=%v\n\t   got %v\n", test.path, test.tolerance, test.wanted, got)
+		}
+	}
+	if got := visvalingam(noisy, 1, box); !got.Equal(tests[1].wanted) {
+		t.Errorf("Visvalingam %v:\n\twanted=%v\n\t   got %v\n", noisy, tests[1].wanted, got)
+	}
+	if got := visvalingam(tiny, 100, box); len(got) != 4 || !got.IsClosed() {
+		t.Errorf("Visvalingam should leave a triangle of %v, got %v\n", tiny, got)
+	}
+	if got := visvalingam(tests[3].path, 100, box); !got.Equal(tests[3].wanted) {
+		t.Errorf("Visvalingam %v:\n\twanted=%v\n\t   got %v\n", tests[3].path, tests[3].wanted, got)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	fmt.Println("TestFilter")
+	square := func(x, y, size float64) ContourT {
+		return ContourT{{x, y}, {x + size, y}, {x + size, y + size}, {x, y + size}, {x, y}}
+	}
+	big := square(20, 20, 10)
+	small := square(0, 0, 3)
+	hole := square(1, 1, 1)
+	// inside small, but longer than it
+	zigzag := ContourT{{0.5, 0.5}, {2.5, 0.5}, {0.6, 1}, {2.5, 1.5}, {0.6, 2}, {2.5, 2.5}, {0.5, 2.5}, {0.5, 0.5}}
+	tests := []struct {
+		minLength, minArea string
+		maxCount           int
+		contours, wanted   ContourS
+	}{
+		{"10px", "0", 0, ContourS{big, small, hole}, ContourS{big, small}},
+		{"0", "5px", 0, ContourS{big, small, hole}, ContourS{big, small}},
+		// at 0.5mm a pixel, 2.5mm² is 10 pixels
+		{"0", "2.5", 0, ContourS{big, small, hole}, ContourS{big}},
+		{"0", "0", 2, ContourS{big, small, zigzag}, ContourS{big}},
+		{"0", "0", 5, ContourS{big, small, zigzag}, ContourS{big, small, zigzag}},
+	}
+	for _, test := range tests {
+		var opts OptsT
+		opts.minLength, _ = parseSize(test.minLength)
+		opts.minArea, _ = parseSize(test.minArea)
+		opts.maxCount = test.maxCount
+		got, dropped := filterContours(test.contours, opts, 0.5)
+		if got.String() != test.wanted.String() || dropped != len(test.contours)-len(test.wanted) {
+			t.Errorf("Filter %s %s %d:\n\twanted=%v\n\t   got %v, %d dropped\n", test.minLength, test.minArea, test.maxCount, test.wanted, got, dropped)
+		}
+	}
+	for _, bad := range []string{"", "x", "-2", "3pxx"} {
+		if _, err := parseSize(bad); err == nil {
+			t.Errorf("Size '%s' should be invalid\n", bad)
+		}
+	}
+}
+
+func TestNest(t *testing.T) {
+	fmt.Println("TestNest")
+	// A dark square ring, two pixels thick, with a dark island in the middle
+	// of its hole, and a pixel that's only dark at the higher threshold
+	hm := newHeightMap(9, 9)
+	hm.low, hm.high = 0, 255
+	for y := 0; y < 9; y++ {
+		for x := 0; x < 9; x++ {
+			ring := x >= 1 && x <= 7 && y >= 1 && y <= 7 && (x <= 2 || x >= 6 || y <= 2 || y >= 6)
+			if ring || (x == 4 && y == 4) {
+				hm.values[x+y*9] = 0
+			} else {
+				hm.values[x+y*9] = 255
+			}
+		}
+	}
+	hm.values[8+4*9] = 150
+	high, _ := contourFinder(hm, 9, 9, 200)
+	low, _ := contourFinder(hm, 9, 9, 100)
+	wanted := []NodeT{
+		{parent: -1, children: []int{1}, hole: false},
+		{parent: 0, children: []int{2}, hole: true},
+		{parent: 1, hole: false},
+	}
+	for _, test := range []struct {
+		contours, higher ContourS
+		enclosing        []int
+	}{
+		{high, nil, []int{-1, -1, -1}},
+		{low, high, []int{0, 0, 2}},
+	} {
+		nodes := nestContours(test.contours, test.higher)
+		if len(nodes) != len(wanted) {
+			t.Errorf("Wanted %d contours, got %d: %v\n", len(wanted), len(nodes), test.contours)
+			continue
+		}
+		for i, node := range nodes {
+			want := wanted[i]
+			want.enclosing = test.enclosing[i]
+			if node.parent != want.parent || node.hole != want.hole || node.enclosing != want.enclosing || !slices.Equal(node.children, want.children) {
+				t.Errorf("Contour %d: wanted %+v, got %+v\n", i, want, node)
+			}
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	fmt.Println("TestReport")
+	infile := copyTestImage(t, "test3.png")
+	dir := filepath.Dir(infile)
+	reportFile := filepath.Join(dir, "report.json")
+	opts := OptsT{infile: infile, thresholds: []float64{128}, tcount: -1, margin: 15, paper: "A4L", linewidth: 0.5, report: reportFile}
+	parsePaperSize(&opts)
+	createOutput(opts)
+	js, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatalf("Can't read the report: %s", err)
+	}
+	var report ReportT
+	if err := json.Unmarshal(js, &report); err != nil {
+		t.Fatalf("Can't decode the report: %s\n%s\n", err, js)
+	}
+	// Three outer boundaries, with the areas and lengths of those in TestJoin, at 22.5mm a pixel
+	if len(report.Levels) != 1 || report.Scale != 22.5 {
+		t.Fatalf("Wrong levels or scale in the report:\n%s\n", js)
+	}
+	level := report.Levels[0]
+	if level.Threshold != 128 || level.Contours != 3 || level.Holes != 0 || level.Points != 13+33+9 || level.CompressedPoints > level.Points {
+		t.Errorf("Wrong counts in the report:\n%s\n", js)
+	}
+	if !almostEqual(level.AreaPixels, 57.556, 0.001) || !almostEqual(level.Area, level.AreaPixels*22.5*22.5, 0.001) ||
+		!almostEqual(level.MeanLength, level.Length/3, 0.001) || level.MinLength > level.MaxLength {
+		t.Errorf("Wrong areas or lengths in the report:\n%s\n", js)
+	}
+	if report.Total.Contours != 3 || report.Total.Length != level.Length {
+		t.Errorf("Wrong total in the report:\n%s\n", js)
+	}
+	// and as a table
+	opts.report = filepath.Join(dir, "report.txt")
+	createOutput(opts)
+	table, err := os.ReadFile(opts.report)
+	if err != nil {
+		t.Fatalf("Can't read the report: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(table)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "threshold") || !strings.HasPrefix(strings.TrimSpace(lines[1]), "128") || !strings.HasPrefix(strings.TrimSpace(lines[2]), "total") {
+		t.Errorf("Wrong table:\n%s\n", table)
+	}
+}
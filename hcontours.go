@@ -20,7 +20,7 @@ package main
 
 import (
 	"fmt"
-	"image"
+	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"math"
@@ -28,6 +28,7 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -38,19 +39,14 @@ var hcName = path.Base(os.Args[0])
 
 const hcVersion = "0.1.2"
 
-// Get the pixel value (0..255) at the given coordinates in the image
-// Grey: Y = 0.299 R + 0.587 G + 0.114 B
-// FIXME use Pix or At ?
-func getPix(imageData *image.NRGBA, width, height int, p PointT) int {
-	if p.x < 0 || p.y < 0 || p.x >= width || p.y >= height {
-		//fmt.Printf("gP: p=%v  off edge, returning %v\n", p, white)
-		return white
-	}
-	pixIndex := p.y*imageData.Stride + p.x*4
-	//at := imageData.At(p.x, p.y)
-	pixVal := int(math.Round(0.299*float64(imageData.Pix[pixIndex]) + 0.587*float64(imageData.Pix[pixIndex+1]) + 0.114*float64(imageData.Pix[pixIndex+2])))
-	//fmt.Printf("gP: p=%v  len(Pix)=%v stride=%v  pixIndex=%v  pixVal=%v  at=%v\n", p, len(imageData.Pix), imageData.Stride, pixIndex, pixVal, at)
-	return pixVal
+// Get the value at the given coordinates in the height map.
+// Anything off the image, or with no data, counts as higher than any threshold.
+func getPix(hm *HeightMapT, width, height int, p PointT) float64 {
+	if p.x < 0 || p.y < 0 || p.x >= width || p.y >= height || hm.noData(p.x, p.y) {
+		//fmt.Printf("gP: p=%v  off edge, returning %v\n", p, offImageValue)
+		return offImageValue
+	}
+	return hm.at(p.x, p.y)
 }
 
 // Calculate the weighted average between points 'out' and 'in',
@@ -59,14 +55,20 @@ func getPix(imageData *image.NRGBA, width, height int, p PointT) int {
 // than the in pixel, and the threshold to be in the range [inPix, outPix].
 // The answer is shifted by 0.5 in each direction to account for
 // the fence-post error: we're moving from the centres of pixels to the edges.
-func pointWeightedAvg(out, in PointT, outPix, inPix, threshold int, width, height int) Point64T {
+// An out pixel with no data (outPix is infinite) gives a point just inside it,
+// so that the contour can be broken there.
+func pointWeightedAvg(out, in PointT, outPix, inPix, threshold float64, width, height int) Point64T {
 	if outPix == inPix || outPix < threshold || threshold < inPix {
 		panic(fmt.Sprintf("pointWeightedAvg: invalid values for outPix (%v), threshold (%v), and inPix (%v)\n", outPix, threshold, inPix))
 	}
-	proportion := float64(outPix-threshold) / float64(outPix-inPix)
-	var pwa Point64T
 	// Have to deal with edges separately: make the average slightly off-image
+	// (or slightly into the no-data pixel)
 	const slightly = 0.001
+	proportion := 0.5 - slightly
+	if !math.IsInf(outPix, 1) {
+		proportion = (outPix - threshold) / (outPix - inPix)
+	}
+	var pwa Point64T
 	if out.x < 0 {
 		pwa.x = -slightly
 	} else if out.x >= width {
@@ -94,7 +96,7 @@ func pointWeightedAvg(out, in PointT, outPix, inPix, threshold int, width, heigh
 // - else turn right
 // (i.e. just a line-following thing)
 // * accumulate weighted mid-points of each in/out pair
-func traceContour(imageData *image.NRGBA, width, height int, threshold int, start PointT, svgF *SVGfile) (ContourT, []PointT, float64) {
+func traceContour(hm *HeightMapT, width, height int, threshold float64, start PointT) (ContourT, []PointT, float64) {
 	contour := make(ContourT, 0, 10)
 	contourLen := 0.0
 	seen := make([]PointT, 1, 10) // Annoyingly, we need to also return a list of in-shape pixels
@@ -102,8 +104,8 @@ func traceContour(imageData *image.NRGBA, width, height int, threshold int, star
 	direction := DirectionT(approachDir) // we bumped into start pixel moving in +v x direction
 	in := start                          // pixel in the shape
 	out := in.Backstep(direction)        // one step back -- gives pixel outside the shape
-	inPix := getPix(imageData, width, height, in)
-	outPix := getPix(imageData, width, height, out)
+	inPix := getPix(hm, width, height, in)
+	outPix := getPix(hm, width, height, out)
 	prevPoint := pointWeightedAvg(out, in, outPix, inPix, threshold, width, height)
 	contour = append(contour, prevPoint)
 	direction.TurnLeft()
@@ -120,8 +122,8 @@ func traceContour(imageData *image.NRGBA, width, height int, threshold int, star
 		nextOut := out.Step(direction)
 		nextIn := in.Step(direction)
 
-		nextOutPix := getPix(imageData, width, height, nextOut)
-		nextInPix := getPix(imageData, width, height, nextIn)
+		nextOutPix := getPix(hm, width, height, nextOut)
+		nextInPix := getPix(hm, width, height, nextIn)
 
 		if nextOutPix < threshold { // If next cell on the left is in the shape, turn left
 			in = nextOut
@@ -166,22 +168,20 @@ func b2c(b bool) string {
 	return "f"
 }
 
-func contourFinder(imageData *image.NRGBA, width, height int, threshold int, clip bool, svgF *SVGfile) (ContourS, float64) {
+// Find all the contours at the given threshold, as closed loops, in the order
+// that they're found, scanning from the top left.
+func contourFinder(hm *HeightMapT, width, height int, threshold float64) (ContourS, float64) {
 	seen := make([]bool, width*height)
 	skipping := false
 	contourCount := 0
 	contours := make(ContourS, 0, 3)
 	totalLen := 0.0
-	if clip {
-		// start the path -- single path for all contours.   TODO maybe like this for non-clipped paths
-		svgF.closedPathStart("")
-	}
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
 			p := PointT{x, y}
-			if getPix(imageData, width, height, p) < threshold {
+			if getPix(hm, width, height, p) < threshold {
 				if !seen[x+y*width] && !skipping {
-					contour, moreSeen, contourLen := traceContour(imageData, width, height, threshold, p, svgF)
+					contour, moreSeen, contourLen := traceContour(hm, width, height, threshold, p)
 					contourCount += 1
 					contours = append(contours, contour)
 					totalLen += contourLen
@@ -189,13 +189,6 @@ func contourFinder(imageData *image.NRGBA, width, height int, threshold int, cli
 					for _, p := range moreSeen {
 						seen[p.x+p.y*width] = true
 					}
-					if svgF != nil {
-						if clip {
-							svgF.plotContourClip(contour, width, height)
-						} else {
-							svgF.plotContour(contour, width, height)
-						}
-					}
 				}
 				skipping = true
 			} else {
@@ -203,11 +196,6 @@ func contourFinder(imageData *image.NRGBA, width, height int, threshold int, cli
 			}
 		}
 	}
-	if clip {
-		// finish the (closed) path
-		svgF.closedPathStop()
-	}
-	// contours are really only returned for test cases
 	return contours, totalLen
 }
 
@@ -249,15 +237,57 @@ func parsePaperSize(opts *OptsT) bool {
 func parseArgs(args []string) (OptsT, bool) {
 	var opts OptsT
 	pf := pflag.NewFlagSet("contours", pflag.ExitOnError)
-	pf.IntSliceVarP(&opts.thresholds, "threshold", "t", []int{128}, "Threshold levels, each 0..255, separated by commas.")
+	pf.Float64SliceVarP(&opts.thresholds, "threshold", "t", []float64{128}, "Threshold levels, in the range of the image's values (0..255 for 8-bit images, 0..65535 for 16-bit), separated by commas.")
 	pf.IntVarP(&opts.tcount, "tcount", "T", 1, "Number of evenly-spaced threshold levels (unless overridden by --threshold).")
+	pf.Float64Var(&opts.interval, "interval", 0, "Put thresholds at this interval (unless overridden by --threshold).")
+	pf.StringVar(&opts.autoThresholds, "auto-thresholds", "", "Choose --tcount thresholds from the image's histogram: otsu | quantile | kmeans.")
+	pf.Float64Var(&opts.base, "base", 0, "Base level for --interval: thresholds are at base + k * interval.")
+	pf.Float64Var(&opts.tmin, "tmin", 0, "Lowest threshold for --interval and --tcount.  Default: the lowest value in the input.")
+	pf.Float64Var(&opts.tmax, "tmax", 0, "Highest threshold for --interval and --tcount.  Default: the highest value in the input.")
+	pf.Float64SliceVar(&opts.valueRange, "value-range", nil, "Map the input's values linearly onto this range, e.g. '120,1340' for black=120 and white=1340.")
 	pf.Float64VarP(&opts.margin, "margin", "m", 15, "Minimum margin (in mm).")
 	pf.StringVarP(&opts.paper, "paper", "p", "A4L", "Paper size and orientation.  A4L | A4P | A3L | A3P.")
 	pf.Float64VarP(&opts.linewidth, "linewidth", "l", 0.5, "Width of contour lines, in mm.")
 	pf.Float64VarP(&opts.framewidth, "framewidth", "f", 0.0, "Width of frame lines, if any, in mm.")
+	pf.IntVar(&opts.indexEvery, "index-every", 0, "Make every Nth contour an index contour, drawn with --index-linewidth and --index-colour.")
+	pf.Float64Var(&opts.indexLinewidth, "index-linewidth", 0, "Width of index contour lines, in mm.  Default: twice --linewidth.")
+	pf.StringVar(&opts.indexColour, "index-colour", "", "Colour of index contour lines, e.g. '7f3f00'.  Default: black.")
+	pf.StringVar(&opts.styles, "styles", "", "Stroke styles for the contour levels, separated by ';', e.g. 'ff0000,width=0.3;0000ff,dash=2/1,opacity=0.8'.")
+	pf.StringVar(&opts.stylesFile, "styles-file", "", "File of stroke styles for the contour levels, one per line.")
 	pf.StringVarP(&opts.colours, "colours", "C", "", "Colours used to fill the contour levels, e.g. 'ffff00,ff0000'. Implies --clip.")
 	pf.BoolVarP(&opts.image, "image", "i", false, "Use the original image as a background in the SVG image.")
 	pf.BoolVarP(&opts.clip, "clip", "c", false, "Clip borders of image, rather than breaking contours.")
+	pf.BoolVar(&opts.clipGeometry, "clip-geometry", false, "Leave out the clip path, so that filled SVG and PDF have nothing in them that plotters ignore (implies --clip).")
+	pf.Float64Var(&opts.clipInset, "clip-inset", 0, "Clip this far (in mm) inside the edge of the image.")
+	pf.StringVar(&opts.inputFormat, "input-format", "auto", "Input file format: auto | image | asc | csv | hgt | geotiff.  'auto' goes by the file name's extension.")
+	pf.Float64Var(&opts.nodata, "nodata", 0, "Value that marks pixels or grid cells with no data.")
+	pf.StringVar(&opts.channel, "channel", "luma601", "How pixel colours become values: r | g | b | alpha | luma601 | luma709 | value | hue | saturation | mix:<r>,<g>,<b> | mapbox | terrarium.")
+	pf.BoolVar(&opts.invert, "invert", false, "Swap light and dark, so that light is low.")
+	pf.StringVar(&opts.mask, "mask", "", "Image whose black or transparent pixels mark places with no data.")
+	pf.Float64Var(&opts.alphaCutoff, "alpha-cutoff", 0.5, "Pixels with alpha (0..1) below this have no data.")
+	pf.StringVar(&opts.format, "format", "svg", "Output format: svg | gcode | hpgl | dxf | geojson | pdf.")
+	pf.StringVar(&opts.gcodePen, "gcode-pen", "z", "How G-code lifts the pen: z (moves the Z axis) | servo (M3 S<value>).")
+	pf.Float64Var(&opts.penUp, "pen-up", 5, "Z height (in mm), or servo setting, for the pen up.  Default: 5 for z, 50 for servo.")
+	pf.Float64Var(&opts.penDown, "pen-down", 0, "Z height (in mm), or servo setting, for the pen down.  Default: 0 for z, 30 for servo.")
+	pf.Float64Var(&opts.penDelay, "pen-delay", 0, "Time (in seconds) to wait after lifting or lowering the pen.")
+	pf.BoolVar(&opts.penChange, "pen-change", false, "Pause between layers so that the pen can be changed.")
+	pf.Float64Var(&opts.feedRate, "feed-rate", 1000, "Speed of drawing moves, in mm/minute.")
+	pf.Float64Var(&opts.travelRate, "travel-rate", 0, "Speed of pen-up moves, in mm/minute.  Default: as fast as possible.")
+	pf.StringVar(&opts.gcodeOrigin, "gcode-origin", "bottom-left", "Where the machine's origin is on the paper: bottom-left | top-left | centre.")
+	pf.IntSliceVar(&opts.pens, "pens", []int{1}, "HPGL pens for the contour levels, in turn, starting with the lowest, e.g. '1,2,3'.")
+	pf.BoolVar(&opts.join, "join", false, "Join the pieces of contours that have been broken at the edge of the image, where they meet.")
+	pf.BoolVar(&opts.joinFrame, "join-frame", false, "Also join pieces of contours by going along the edge of the image (implies --join).")
+	minLength := pf.String("min-length", "0", "Leave out contours shorter than this, in mm on the paper, or in pixels with 'px', e.g. '2' or '10px'.")
+	minArea := pf.String("min-area", "0", "Leave out contours enclosing less than this, in mm² on the paper, or in pixels with 'px'.")
+	pf.IntVar(&opts.maxCount, "max-count", 0, "Leave out all but this many of the longest contours at each threshold.  Default: keep them all.")
+	pf.Float64Var(&opts.simplify, "simplify", 0, "Leave out points that make less difference than this (in mm) to the contours.")
+	pf.StringVar(&opts.simplifyMethod, "simplify-method", "rdp", "How to simplify the contours: rdp (Ramer-Douglas-Peucker) | visvalingam (Visvalingam-Whyatt).")
+	pf.StringVar(&opts.smooth, "smooth", "none", "Smooth the contours: none | chaikin (cut the corners off) | curve (draw curves through the points).")
+	pf.BoolVar(&opts.order, "order", false, "Put the paths in each layer in order, to cut down the distance travelled with the pen up.")
+	pf.BoolVar(&opts.keepDirection, "keep-direction", false, "When ordering paths, don't draw any of them backwards.")
+	pf.StringVar(&opts.report, "report", "", "Write statistics for each threshold to this file: JSON if it ends in '.json', otherwise a table; '-' for a table on the screen.")
+	pf.StringVar(&opts.preview, "preview", "", "Also draw a PNG preview of the result, in this file.")
+	pf.Float64Var(&opts.previewDPI, "preview-dpi", 150, "Resolution of the preview, in dots per inch.")
 	pf.BoolVarP(&opts.debug, "debug", "d", false, "Add extra bits to the SVG -- intended for developer use only.")
 	pf.SortFlags = false
 	if args == nil {
@@ -271,11 +301,16 @@ func parseArgs(args []string) (OptsT, bool) {
 		ok = false
 	}
 	if pf.Changed("threshold") {
-		// User has set thresholds -- don't use tcount
+		// User has set thresholds -- don't use tcount, interval, or automatic thresholds
 		opts.tcount = -1
+		opts.interval = 0
+		opts.autoThresholds = ""
+	} else if opts.interval < 0 {
+		fmt.Printf("Invalid interval %g\n", opts.interval)
+		ok = false
 	} else {
+		// thresholds are set once the image's range of values is known
 		opts.tcount = limitInt(opts.tcount, 1, 255)
-		opts.thresholds = evenThresholds(opts.tcount)
 	}
 	if pf.Changed("colours") {
 		// Case-insensitive, 6 hex-chars, comma, 6 hex-chars
@@ -288,6 +323,141 @@ func parseArgs(args []string) (OptsT, bool) {
 		// implies --clip
 		opts.clip = true
 	}
+	opts.inputFormat = strings.ToLower(opts.inputFormat)
+	if !slices.Contains(inputFormats, opts.inputFormat) {
+		fmt.Printf("Unknown input format '%s'\n", opts.inputFormat)
+		ok = false
+	}
+	if opts.indexEvery < 0 || opts.indexLinewidth < 0 {
+		fmt.Println("Invalid --index-every or --index-linewidth")
+		ok = false
+	}
+	if opts.indexColour != "" && !validColour.MatchString(opts.indexColour) {
+		fmt.Printf("Invalid index colour '%s'\n", opts.indexColour)
+		ok = false
+	}
+	opts.indexColour = strings.ToLower(opts.indexColour)
+	if opts.styles != "" && opts.stylesFile != "" {
+		fmt.Println("Can't use both --styles and --styles-file")
+		ok = false
+	} else {
+		var err error
+		if opts.styles != "" {
+			opts.strokeStyles, err = parseStrokeStyles(opts.styles)
+		} else if opts.stylesFile != "" {
+			opts.strokeStyles, err = loadStrokeStyles(opts.stylesFile)
+		}
+		if err != nil {
+			fmt.Println(err)
+			ok = false
+		}
+	}
+	opts.autoThresholds = strings.ToLower(opts.autoThresholds)
+	if opts.autoThresholds != "" {
+		if !slices.Contains(autoThresholdMethods, opts.autoThresholds) {
+			fmt.Printf("Unknown method for automatic thresholds '%s'\n", opts.autoThresholds)
+			ok = false
+		}
+		if opts.interval > 0 {
+			fmt.Println("Can't use --interval with --auto-thresholds")
+			ok = false
+		}
+	}
+	opts.tminSet = pf.Changed("tmin")
+	opts.tmaxSet = pf.Changed("tmax")
+	if opts.tminSet && opts.tmaxSet && opts.tmin > opts.tmax {
+		fmt.Printf("--tmin %g is more than --tmax %g\n", opts.tmin, opts.tmax)
+		ok = false
+	}
+	if pf.Changed("value-range") && (len(opts.valueRange) != 2 || opts.valueRange[0] >= opts.valueRange[1]) {
+		fmt.Printf("Invalid value range %v -- need a low value and a higher one, e.g. '120,1340'\n", opts.valueRange)
+		ok = false
+	}
+	if _, err := parseChannel(opts.channel); err != nil {
+		fmt.Println(err)
+		ok = false
+	}
+	opts.format = strings.ToLower(opts.format)
+	if !slices.Contains(outputFormats, opts.format) {
+		fmt.Printf("Unknown output format '%s'\n", opts.format)
+		ok = false
+	}
+	opts.gcodePen = strings.ToLower(opts.gcodePen)
+	if !slices.Contains(gcodePens, opts.gcodePen) {
+		fmt.Printf("Unknown G-code pen '%s'\n", opts.gcodePen)
+		ok = false
+	}
+	if opts.gcodePen == "servo" {
+		if !pf.Changed("pen-up") {
+			opts.penUp = 50
+		}
+		if !pf.Changed("pen-down") {
+			opts.penDown = 30
+		}
+	}
+	opts.gcodeOrigin = strings.ToLower(opts.gcodeOrigin)
+	if opts.gcodeOrigin == "center" {
+		opts.gcodeOrigin = "centre"
+	}
+	if !slices.Contains(gcodeOrigins, opts.gcodeOrigin) {
+		fmt.Printf("Unknown G-code origin '%s'\n", opts.gcodeOrigin)
+		ok = false
+	}
+	if opts.feedRate <= 0 || opts.travelRate < 0 || opts.penDelay < 0 {
+		fmt.Println("Invalid --feed-rate, --travel-rate, or --pen-delay")
+		ok = false
+	}
+	if opts.previewDPI <= 0 || opts.previewDPI > 2400 {
+		fmt.Printf("Invalid preview resolution %g\n", opts.previewDPI)
+		ok = false
+	}
+	for _, pen := range opts.pens {
+		if pen < 1 || pen > 255 {
+			fmt.Printf("Invalid pen %d in --pens\n", pen)
+			ok = false
+		}
+	}
+	var err error
+	if opts.minLength, err = parseSize(*minLength); err != nil {
+		fmt.Printf("Invalid --min-length: %s\n", err)
+		ok = false
+	}
+	if opts.minArea, err = parseSize(*minArea); err != nil {
+		fmt.Printf("Invalid --min-area: %s\n", err)
+		ok = false
+	}
+	if opts.maxCount < 0 {
+		fmt.Printf("Invalid --max-count %d\n", opts.maxCount)
+		ok = false
+	}
+	if opts.simplify < 0 {
+		fmt.Printf("Invalid simplification tolerance %g\n", opts.simplify)
+		ok = false
+	}
+	opts.simplifyMethod = strings.ToLower(opts.simplifyMethod)
+	if !slices.Contains(simplifyMethods, opts.simplifyMethod) {
+		fmt.Printf("Unknown simplification method '%s'\n", opts.simplifyMethod)
+		ok = false
+	}
+	opts.smooth = strings.ToLower(opts.smooth)
+	if !slices.Contains(smoothModes, opts.smooth) {
+		fmt.Printf("Unknown smoothing '%s'\n", opts.smooth)
+		ok = false
+	}
+	if opts.smooth == "none" {
+		opts.smooth = ""
+	}
+	if opts.joinFrame {
+		opts.join = true
+	}
+	if opts.clipGeometry || opts.clipInset > 0 {
+		opts.clip = true
+	}
+	if opts.clipInset < 0 {
+		fmt.Printf("Invalid clip inset %g\n", opts.clipInset)
+		ok = false
+	}
+	opts.nodataSet = pf.Changed("nodata")
 	opts.infile = pf.Arg(0)
 	ok = ok && parsePaperSize(&opts)
 	if ok {
@@ -300,7 +470,7 @@ func parseArgs(args []string) (OptsT, bool) {
 	return opts, ok
 }
 
-func buildSVGfilename(opts OptsT) string {
+func buildFilename(opts OptsT) string {
 	frameString := ""
 	if opts.framewidth > 0.0 {
 		frameString = fmt.Sprintf("F%g", opts.framewidth)
@@ -313,60 +483,152 @@ func buildSVGfilename(opts OptsT) string {
 	if opts.clip {
 		clipString = "C"
 	}
+	if opts.clipGeometry {
+		clipString += "G"
+	}
+	if opts.clipInset > 0 {
+		clipString += fmt.Sprintf("n%g", opts.clipInset)
+	}
 	tString := ""
-	if opts.tcount == -1 {
-		tString = "t" + intsToString(opts.thresholds)
+	if opts.tcount == -1 || opts.autoThresholds != "" {
+		tString = "t" + floatsToString(opts.thresholds)
+	} else if opts.interval > 0 {
+		tString = fmt.Sprintf("i%gb%g", opts.interval, opts.base)
 	} else {
 		tString = fmt.Sprintf("T%d", opts.tcount)
 	}
+	if len(opts.valueRange) == 2 {
+		tString += "v" + floatsToString(opts.valueRange)
+	}
 	colourString := ""
 	if opts.colours != "" {
 		colourString = "C" + opts.colours
-		clipString = "" // don't need that as well
+		clipString = strings.TrimPrefix(clipString, "C") // don't need that as well
 	}
 	optString := fmt.Sprintf("-hc-%sm%gp%s%s%s%s%s", tString, opts.margin, opts.paper, frameString, imageString, clipString, colourString)
 	ext := filepath.Ext(opts.infile)
-	filename := strings.TrimSuffix(opts.infile, ext) + optString + ".svg"
+	outExt, ok := formatExtensions[opts.format]
+	if !ok {
+		outExt = ".svg"
+	}
+	filename := strings.TrimSuffix(opts.infile, ext) + optString + outExt
 	return filename
 }
 
-func createSVG(opts OptsT) string {
-	var svgF *SVGfile = new(SVGfile)
-	img, width, height, err := loadImage(opts.infile)
+// Find the contours, and plot them in the chosen format.
+// Returns the name of the file created.
+func createOutput(opts OptsT) string {
+	plotter := newPlotter(opts.format)
+	img, width, height, err := loadHeightMap(opts)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(2)
 	}
+	if opts.image && resolveInputFormat(opts.infile, opts.inputFormat) != "image" {
+		fmt.Println("Input is not an image, so --image is ignored")
+		opts.image = false
+	}
 	opts.width = width
 	opts.height = height
-	svgFilename := buildSVGfilename(opts)
-	svgF.open(svgFilename)
-	svgF.writeComment(fmt.Sprintf("%s, created by %s version %s", svgFilename, hcName, hcVersion))
+	opts.geo = img.geo
+	opts.thresholds, err = chooseThresholds(opts, img)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if opts.autoThresholds != "" {
+		fmt.Printf("Thresholds chosen by %s: %s\n", opts.autoThresholds, floatsToString(opts.thresholds))
+	}
+	if err := checkClipBox(opts); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	filename := buildFilename(opts)
+	plotter.open(filename)
+	plotter.writeComment(fmt.Sprintf("%s, created by %s version %s", filename, hcName, hcVersion))
 	// This doesn't work, because "--" in option prefixes messes with XML comments:
 	//svgF.writeComment(fmt.Sprintf("Command line: %s %s", path.Base(os.Args[0]), strings.Join(os.Args[1:], " ")))
 	// - could do something clever by extracing the command line information from spflag with short -x flags.
-	svgF.writeComment(fmt.Sprintf("Options used: %v", opts))
-	scale := svgF.start(opts)
+	plotter.writeComment(fmt.Sprintf("Options used: %v", opts))
+	if img.geo != nil {
+		topLeft := img.geo.toWorld(Point64T{0, 0})
+		bottomRight := img.geo.toWorld(Point64T{float64(width), float64(height)})
+		plotter.writeComment(fmt.Sprintf("Georeference: top left %g,%g  bottom right %g,%g  transform %v", topLeft.x, topLeft.y, bottomRight.x, bottomRight.y, *img.geo))
+	}
+	scale := plotter.start(opts)
+	var preview *PreviewFile
+	if opts.preview != "" {
+		preview = new(PreviewFile)
+		preview.open(opts.preview)
+		preview.start(opts)
+	}
+	styles := layerStyles(opts)
 	contourText := make([]string, len(opts.thresholds))
 	totalLen := 0.0
+	// pen-up travel, before and after ordering, from the top left of the image
+	var penUpBefore, penUpAfter float64
+	var penBefore, penAfter Point64T
+	var higher ContourS // the contours at the threshold above
+	levels := make([]LevelReportT, len(opts.thresholds))
 	for i := len(opts.thresholds) - 1; i >= 0; i-- {
-		threshold := opts.thresholds[i]
-		//fmt.Printf("cSVG: i=%d threshold=%d starting layer %d\n", i, threshold, i+1)
-		svgF.layer(i+1 /* threshold */, "contour", i)
-		contours, thresholdLen := contourFinder(img, opts.width, opts.height, threshold, opts.clip, svgF)
-		contourText[i] = fmt.Sprintf("%d contours found at threshold %d, with length %.2fm", len(contours), threshold, thresholdLen*scale/1000)
-		totalLen += thresholdLen
-	}
-	svgF.endLayer()
+		layer := LayerT{index: i + 1, threshold: opts.thresholds[i], label: "contour", style: styles[i+1]}
+		if layer.style.index {
+			layer.label = "index"
+		}
+		layer.contours, layer.length = contourFinder(img, opts.width, opts.height, layer.threshold)
+		found := len(layer.contours)
+		if filtering(opts) {
+			layer.contours, layer.dropped = filterContours(layer.contours, opts, scale)
+			layer.length = 0
+			for _, contour := range layer.contours {
+				layer.length += contour.Length()
+			}
+		}
+		layer.nodes = nestContours(layer.contours, higher)
+		higher = layer.contours
+		layer.makePaths(img, opts)
+		if opts.order {
+			var dist float64
+			dist, penBefore = penUpDistance(layer.paths, penBefore)
+			penUpBefore += dist
+			layer.paths = orderPaths(layer.paths, penAfter, !opts.keepDirection)
+			dist, penAfter = penUpDistance(layer.paths, penAfter)
+			penUpAfter += dist
+		}
+		plotter.plotLayer(&layer)
+		if preview != nil {
+			preview.plotLayer(&layer)
+		}
+		contourText[i] = fmt.Sprintf("%d contours found at threshold %g, with length %.2fm", found, layer.threshold, layer.length*scale/1000)
+		if filtering(opts) {
+			contourText[i] += fmt.Sprintf(", %d dropped", layer.dropped)
+		}
+		levels[i] = levelReport(&layer, scale)
+		if opts.simplify > 0 {
+			contourText[i] += fmt.Sprintf(", simplified from %d points to %d", layer.points, countPoints(layer.paths))
+		}
+		totalLen += layer.length
+	}
 	for _, text := range contourText {
 		fmt.Println(text)
-		svgF.writeComment(text)
+		plotter.writeComment(text)
 	}
 	text := fmt.Sprintf("Total contour length: %.2fm", totalLen*scale/1000)
 	fmt.Println(text)
-	svgF.writeComment(text)
-	svgF.stopSave()
-	return svgFilename
+	plotter.writeComment(text)
+	if opts.order {
+		text = fmt.Sprintf("Pen-up distance: %.2fm, down from %.2fm before ordering", penUpAfter*scale/1000, penUpBefore*scale/1000)
+		fmt.Println(text)
+		plotter.writeComment(text)
+	}
+	plotter.stopSave()
+	if preview != nil {
+		preview.stopSave()
+	}
+	if opts.report != "" {
+		ReportT{Input: opts.infile, Scale: scale, Levels: levels, Total: totalReport(levels)}.save(opts.report)
+	}
+	return filename
 }
 
 func main() {
@@ -377,5 +639,5 @@ func main() {
 	fmt.Printf("%s: processing '%s'\n", hcName, opts.infile)
 	//fmt.Printf("\t%+v\n", opts)
 	//fmt.Printf("options: %#v\n", opts)
-	_ = createSVG(opts)
+	_ = createOutput(opts)
 }
@@ -0,0 +1,290 @@
+// heightmap.go -- height fields for hcontours.go
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A height map holds one value per pixel, row by row from the top left.
+// Values keep the precision of their source: 0..255 for 8-bit images,
+// 0..65535 for 16-bit images, or any float64 value for other data.
+type HeightMapT struct {
+	width    int
+	height   int
+	values   []float64
+	low      float64  // nominal range of the values -- used for
+	high     float64  // spreading thresholds evenly
+	integral bool     // values are whole numbers, so thresholds can be too
+	geo      *GeoRefT // where the map is in the real world, if known
+}
+
+// A georeference maps pixel coordinates to real-world ones, the same way
+// as a world file:
+//
+//	x' = a*x + b*y + c
+//	y' = d*x + e*y + f
+//
+// except that (0,0) is the top-left corner of the top-left pixel, rather than its centre.
+type GeoRefT struct {
+	a, b, c, d, e, f float64
+}
+
+func (g GeoRefT) toWorld(p Point64T) Point64T {
+	return Point64T{g.a*p.x + g.b*p.y + g.c, g.d*p.x + g.e*p.y + g.f}
+}
+
+func (g GeoRefT) String() string {
+	return fmt.Sprintf("{a: %g, b: %g, c: %g, d: %g, e: %g, f: %g}", g.a, g.b, g.c, g.d, g.e, g.f)
+}
+
+func newHeightMap(width, height int) *HeightMapT {
+	return &HeightMapT{width: width, height: height, values: make([]float64, width*height)}
+}
+
+func (hm *HeightMapT) at(x, y int) float64 {
+	return hm.values[x+y*hm.width]
+}
+
+func (hm *HeightMapT) set(x, y int, v float64) {
+	hm.values[x+y*hm.width] = v
+}
+
+// Values that are NaN are 'no data', and are treated as being off the image.
+func (hm *HeightMapT) noData(x, y int) bool {
+	return math.IsNaN(hm.values[x+y*hm.width])
+}
+
+// Mark all pixels with the given value as having no data.
+func (hm *HeightMapT) setNoData(nodata float64) {
+	for i, v := range hm.values {
+		if v == nodata {
+			hm.values[i] = math.NaN()
+		}
+	}
+}
+
+// Mark pixels as having no data where the image is transparent, i.e. its alpha
+// (0..1) is below the cutoff.  If dark is true, dark pixels also have no data,
+// so that a black and white mask can be used.
+func (hm *HeightMapT) maskImage(img image.Image, alphaCutoff float64, dark bool) {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() && !dark {
+		// nothing to do
+		return
+	}
+	bounds := img.Bounds()
+	for y := 0; y < hm.height; y++ {
+		for x := 0; x < hm.width; x++ {
+			c := color.NRGBA64Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA64)
+			if float64(c.A)/0xffff < alphaCutoff ||
+				(dark && luma601(float64(c.R), float64(c.G), float64(c.B))/0xffff < 0.5) {
+				hm.set(x, y, math.NaN())
+			}
+		}
+	}
+}
+
+// Find the actual range of the values, ignoring pixels with no data.
+func (hm *HeightMapT) valueRange() (float64, float64) {
+	low := math.Inf(1)
+	high := math.Inf(-1)
+	for _, v := range hm.values {
+		if !math.IsNaN(v) {
+			low = math.Min(low, v)
+			high = math.Max(high, v)
+		}
+	}
+	return low, high
+}
+
+// Grey: Y = 0.299 R + 0.587 G + 0.114 B
+func luma601(r, g, b float64) float64 {
+	return 0.299*r + 0.587*g + 0.114*b
+}
+
+// How a pixel's colour is turned into a value: one of the names in
+// channelNames, or a weighted mix of red, green, and blue.
+type ChannelT struct {
+	name    string
+	weights [3]float64 // only for "mix"
+}
+
+var channelNames = []string{"r", "g", "b", "alpha", "luma601", "luma709", "value", "hue", "saturation", "mix", "mapbox", "terrarium"}
+
+// Decoders turn colours into real heights (in metres), rather than into 0..255 or 0..65535.
+func (ch ChannelT) decodes() bool {
+	return ch.name == "mapbox" || ch.name == "terrarium"
+}
+
+var defaultChannel = ChannelT{name: "luma601"}
+
+// Parse a channel name, or a mix given as e.g. "mix:0.5,0.3,0.2".
+// The weights of a mix are scaled to add up to 1.
+func parseChannel(s string) (ChannelT, error) {
+	name, args, hasArgs := strings.Cut(strings.ToLower(s), ":")
+	if !slices.Contains(channelNames, name) {
+		return ChannelT{}, fmt.Errorf("unknown channel '%s'", s)
+	}
+	ch := ChannelT{name: name}
+	if name != "mix" {
+		if hasArgs {
+			return ChannelT{}, fmt.Errorf("channel '%s' doesn't take weights", name)
+		}
+		return ch, nil
+	}
+	weights := strings.Split(args, ",")
+	if !hasArgs || len(weights) != 3 {
+		return ChannelT{}, fmt.Errorf("mix needs three weights, e.g. 'mix:0.5,0.3,0.2', not '%s'", s)
+	}
+	sum := 0.0
+	for i, w := range weights {
+		var err error
+		ch.weights[i], err = strconv.ParseFloat(w, 64)
+		if err != nil || ch.weights[i] < 0 {
+			return ChannelT{}, fmt.Errorf("invalid weight '%s' in '%s'", w, s)
+		}
+		sum += ch.weights[i]
+	}
+	if sum == 0 {
+		return ChannelT{}, fmt.Errorf("weights in '%s' add up to zero", s)
+	}
+	for i := range ch.weights {
+		ch.weights[i] /= sum
+	}
+	return ch, nil
+}
+
+// Turn red, green, blue and alpha, each 0..full, into a value, also 0..full.
+// Hue goes round from red (0) through green (full/3) and blue (2*full/3).
+// The terrain-RGB decoders work on 8-bit colours, and give heights in metres.
+func (ch ChannelT) value(r, g, b, a, full float64) float64 {
+	if ch.decodes() && full != 0xff {
+		r = math.Round(r * 0xff / full)
+		g = math.Round(g * 0xff / full)
+		b = math.Round(b * 0xff / full)
+	}
+	switch ch.name {
+	case "mapbox":
+		return -10000 + (r*65536+g*256+b)*0.1
+	case "terrarium":
+		return r*256 + g + b/256 - 32768
+	case "r":
+		return r
+	case "g":
+		return g
+	case "b":
+		return b
+	case "alpha":
+		return a
+	case "luma709":
+		return 0.2126*r + 0.7152*g + 0.0722*b
+	case "value":
+		return max(r, g, b)
+	case "saturation":
+		if hi := max(r, g, b); hi > 0 {
+			return (hi - min(r, g, b)) / hi * full
+		}
+		return 0
+	case "hue":
+		hi := max(r, g, b)
+		chroma := hi - min(r, g, b)
+		var hue float64 // in sixths of a circle
+		switch {
+		case chroma == 0:
+			hue = 0
+		case hi == r:
+			hue = math.Mod((g-b)/chroma+6, 6)
+		case hi == g:
+			hue = (b-r)/chroma + 2
+		default:
+			hue = (r-g)/chroma + 4
+		}
+		return hue / 6 * full
+	case "mix":
+		return ch.weights[0]*r + ch.weights[1]*g + ch.weights[2]*b
+	}
+	return luma601(r, g, b)
+}
+
+// Convert an image to a height map.  16-bit images keep all 16 bits;
+// anything else goes through NRGBA and ends up in the range 0..255.
+// Decoded heights are used as they are.
+func imageToHeightMap(img image.Image, ch ChannelT) *HeightMapT {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	hm := newHeightMap(width, height)
+	hm.integral = true
+	switch img.(type) {
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		hm.high = 0xffff
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				c := color.NRGBA64Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA64)
+				hm.set(x, y, ch.value(float64(c.R), float64(c.G), float64(c.B), float64(c.A), hm.high))
+			}
+		}
+	default:
+		hm.high = 0xff
+		nrgba := ImageToNRGBA(img)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				pix := nrgba.Pix[y*nrgba.Stride+x*4:]
+				hm.set(x, y, ch.value(float64(pix[0]), float64(pix[1]), float64(pix[2]), float64(pix[3]), hm.high))
+			}
+		}
+	}
+	if ch.decodes() {
+		hm.integral = false
+		hm.low, hm.high = hm.valueRange()
+	} else {
+		for i, v := range hm.values {
+			hm.values[i] = math.Round(v)
+		}
+	}
+	return hm
+}
+
+// Map values linearly so that the range low..high becomes from..to,
+// e.g. to turn 0..255 into real heights.
+func (hm *HeightMapT) mapValues(from, to float64) {
+	if hm.high == hm.low {
+		return
+	}
+	factor := (to - from) / (hm.high - hm.low)
+	for i, v := range hm.values {
+		hm.values[i] = from + (v-hm.low)*factor
+	}
+	hm.low = from
+	hm.high = to
+	hm.integral = false
+}
+
+// Swap light and dark (or high and low), keeping the same range.
+func (hm *HeightMapT) invert() {
+	for i, v := range hm.values {
+		hm.values[i] = hm.low + hm.high - v
+	}
+}
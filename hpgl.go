@@ -0,0 +1,127 @@
+// hpgl.go -- HPGL output for pen plotters
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+const hpglUnitsPerMM = 40
+
+// Maximum number of points in one PD instruction, to keep lines short
+// for plotters with small buffers
+const hpglPointsPerLine = 16
+
+// HPGL has its origin at the bottom left of the paper, with Y going up the
+// page, in plotter units of 0.025mm.  Each layer is drawn with the pen
+// given by the pen table (--pens), starting with the lowest threshold;
+// the frame is drawn with the first pen in the table.
+type HPGLFile struct {
+	file      *os.File
+	filename  string
+	placement PlacementT
+	paper     RectangleT
+	pens      []int
+	pen       int // current pen, 0 for none
+}
+
+func (hp *HPGLFile) write(s string) {
+	fmt.Fprint(hp.file, s)
+}
+
+// HPGL has no comments that vintage plotters will put up with, so these go nowhere.
+func (hp *HPGLFile) writeComment(s string) {
+}
+
+func (hp *HPGLFile) open(filename string) {
+	hp.filename = filename
+	hp.file = createFile(filename)
+}
+
+// Convert a point on the paper (in mm from the top left) to plotter units.
+func (hp *HPGLFile) toPlotter(p Point64T) (int, int) {
+	return int(math.Round(p.x * hpglUnitsPerMM)), int(math.Round((hp.paper.height - p.y) * hpglUnitsPerMM))
+}
+
+func (hp *HPGLFile) selectPen(pen int) {
+	if pen != hp.pen {
+		hp.write(fmt.Sprintf("SP%d;\n", pen))
+		hp.pen = pen
+	}
+}
+
+// Pen for the given layer (1 for the lowest threshold)
+func (hp *HPGLFile) layerPen(l int) int {
+	if len(hp.pens) == 0 {
+		return 1
+	}
+	return hp.pens[(l-1)%len(hp.pens)]
+}
+
+// Draw a path, given in mm on the paper.
+func (hp *HPGLFile) drawPath(path ContourT) {
+	if len(path) < 2 {
+		return
+	}
+	x, y := hp.toPlotter(path[0])
+	hp.write(fmt.Sprintf("PU%d,%d;\n", x, y))
+	coords := make([]string, 0, hpglPointsPerLine)
+	for i, p := range path[1:] {
+		x, y := hp.toPlotter(p)
+		coords = append(coords, fmt.Sprintf("%d,%d", x, y))
+		if len(coords) == hpglPointsPerLine || i == len(path)-2 {
+			hp.write("PD" + strings.Join(coords, ",") + ";\n")
+			coords = coords[:0]
+		}
+	}
+	hp.write("PU;\n")
+}
+
+func (hp *HPGLFile) start(opts OptsT) (scale float64) {
+	hp.placement = newPlacement(opts)
+	hp.paper = opts.paperSize
+	hp.pens = opts.pens
+	hp.write("IN;\n")
+	if opts.framewidth > 0.0 {
+		hp.selectPen(hp.layerPen(1))
+		hp.drawPath(hp.placement.frame(opts))
+	}
+	return hp.placement.scale
+}
+
+func (hp *HPGLFile) plotLayer(layer *LayerT) {
+	hp.selectPen(hp.layerPen(layer.index))
+	for _, path := range layer.paths {
+		paperPath := make(ContourT, len(path))
+		for i, p := range path {
+			paperPath[i] = hp.placement.toPaper(p)
+		}
+		hp.drawPath(paperPath)
+	}
+}
+
+func (hp *HPGLFile) stopSave() {
+	// put the pen away
+	hp.write("PU;\nSP0;\n")
+	hp.file.Close()
+	fmt.Printf("Created HPGL file %q\n", hp.filename)
+}
@@ -0,0 +1,165 @@
+// join.go -- joining up the pieces of contours that have been broken at the edges
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"slices"
+)
+
+// splitContour() breaks a contour wherever it goes off the image, so a contour
+// that starts on the image and then wanders off it ends up as (at least) two
+// pieces that meet where the contour started.  Those can be joined back into one.
+// Pieces that go off the edge of the image and come back on again can also be
+// joined by going along the edge, so that the contour becomes a closed outline
+// against the frame.
+
+// Split a contour as splitContour() does, then join up the pieces that meet.
+// If alongFrame is true, pieces are also joined along the edge of the image.
+func joinContour(contour ContourT, hm *HeightMapT, alongFrame bool) ContourS {
+	pieces := splitPieces(contour, hm)
+	n := len(pieces)
+	if n == 0 || (n == 1 && pieces[0].first == 0 && pieces[0].last == len(contour)-1) {
+		// nothing to join, or it's whole already
+		return splitContour(contour, hm)
+	}
+	// Which pieces join on to the next one (going round the contour), and what goes between them
+	joined := make([]bool, n)
+	between := make(ContourS, n)
+	for i, piece := range pieces {
+		next := pieces[(i+1)%n]
+		exit := piece.path[len(piece.path)-1]
+		entry := next.path[0]
+		if exit.Equal(entry) {
+			joined[i] = true
+		} else if alongFrame {
+			between[i], joined[i] = frameWalk(contour, piece.last, next.first, exit, entry, hm.width, hm.height)
+		}
+	}
+	// Start after a piece that doesn't join on to the next, if there is one
+	start := 0
+	if i := slices.Index(joined, false); i >= 0 {
+		start = (i + 1) % n
+	}
+	var paths ContourS
+	var path ContourT
+	for k := 0; k < n; k++ {
+		i := (start + k) % n
+		path = appendPath(path, pieces[i].path)
+		if !joined[i] {
+			paths = append(paths, path)
+			path = nil
+			continue
+		}
+		path = appendPath(path, between[i])
+	}
+	if path != nil {
+		// everything joined up, so close the loop
+		path = appendPath(path, path[:1])
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// Add points to the end of a path, leaving out the first one if it's where the path ends already.
+func appendPath(path ContourT, points ContourT) ContourT {
+	if len(path) > 0 && len(points) > 0 && path[len(path)-1].Equal(points[0]) {
+		points = points[1:]
+	}
+	return append(path, points...)
+}
+
+// The corners of the image to go past, going along the edge from exit, where
+// a contour goes off the image (after contour[last]), to entry, where it
+// comes back on (before contour[first]).  It goes the same way round as the
+// contour does while it's off the image.  ok is false if either end isn't on
+// the edge, i.e. the contour went into a place with no data.
+func frameWalk(contour ContourT, last, first int, exit, entry Point64T, width, height int) (corners ContourT, ok bool) {
+	w, h := float64(width), float64(height)
+	if !onEdge(exit, w, h) || !onEdge(entry, w, h) {
+		return nil, false
+	}
+	perimeter := 2 * (w + h)
+	from := edgeDistance(exit, w, h)
+	to := from
+	// Follow the contour round, taking each step the short way
+	step := func(p Point64T) {
+		d := edgeDistance(p, w, h) - math.Mod(to, perimeter)
+		to += d - perimeter*math.Round(d/perimeter)
+	}
+	m := len(contour) - 1 // the last point is the same as the first
+	for i := (last + 1) % m; i != first%m; i = (i + 1) % m {
+		if !offImage(contour[i], width, height) {
+			return nil, false
+		}
+		step(contour[i])
+	}
+	step(entry)
+	// The corners passed on the way
+	lo, hi := math.Min(from, to), math.Max(from, to)
+	for k := math.Floor(lo / perimeter); k*perimeter <= hi; k++ {
+		for _, c := range []float64{0, w, w + h, 2*w + h} {
+			if c += k * perimeter; c > lo && c < hi {
+				corners = append(corners, edgePosition(c-k*perimeter, w, h))
+			}
+		}
+	}
+	if to < from {
+		slices.Reverse(corners)
+	}
+	return append(corners, entry), true
+}
+
+const edgeTolerance = 1e-9
+
+func onEdge(p Point64T, w, h float64) bool {
+	return math.Abs(p.x) < edgeTolerance || math.Abs(p.y) < edgeTolerance ||
+		math.Abs(p.x-w) < edgeTolerance || math.Abs(p.y-h) < edgeTolerance
+}
+
+// How far round the edge of the image the nearest point to p is, clockwise
+// (on the page) from the top left corner.
+func edgeDistance(p Point64T, w, h float64) float64 {
+	x := math.Max(0, math.Min(w, p.x))
+	y := math.Max(0, math.Min(h, p.y))
+	// distances to the top, right, bottom, and left edges
+	nearest := slices.Index([]float64{y, w - x, h - y, x}, min(y, w-x, h-y, x))
+	switch nearest {
+	case 0:
+		return x
+	case 1:
+		return w + y
+	case 2:
+		return w + h + (w - x)
+	}
+	return 2*w + h + (h - y)
+}
+
+// The point that's d round the edge of the image from the top left corner
+func edgePosition(d, w, h float64) Point64T {
+	switch {
+	case d <= w:
+		return Point64T{d, 0}
+	case d <= w+h:
+		return Point64T{w, d - w}
+	case d <= 2*w+h:
+		return Point64T{2*w + h - d, h}
+	}
+	return Point64T{0, 2*(w+h) - d}
+}
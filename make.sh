@@ -19,8 +19,7 @@
 # Update examples etc.
 go build
 ./hcontours examples/Heightmap.png -t 64,128,192 --paper 200x200 --margin 0 --framewidth 1.0
-./hcontours examples/beach.png -t 32,64,96,128,160,192,224 --paper A4L --image --linewidth 0.3
-./hcontours examples/beach.png --colours ff0000,777700,00ff00,00ffff,0000ff,770077 -T5
-
-inkscape "examples/beach-hc-t32,64,96,128,160,192,224m15pA4LI.svg" -o "examples/beach-hc-t32,64,96,128,160,192,224m15pA4LI.png"
-inkscape "examples/beach-hc-T5m15pA4LCff0000,777700,00ff00,00ffff,0000ff,770077.svg" -o "examples/beach-hc-T5m15pA4LCff0000,777700,00ff00,00ffff,0000ff,770077.png"
+./hcontours examples/beach.png -t 32,64,96,128,160,192,224 --paper A4L --image --linewidth 0.3 \
+	--preview "examples/beach-hc-t32,64,96,128,160,192,224m15pA4LI.png"
+./hcontours examples/beach.png --colours ff0000,777700,00ff00,00ffff,0000ff,770077 -T5 \
+	--preview "examples/beach-hc-T5m15pA4LCff0000,777700,00ff00,00ffff,0000ff,770077.png"
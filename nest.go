@@ -0,0 +1,106 @@
+// nest.go -- which contours are inside which
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+)
+
+// traceContour() goes round the places that are below the threshold with
+// them on its right (on the page), so it goes clockwise round their outer
+// boundaries, and anticlockwise round holes in them, which therefore have
+// a negative SignedArea().  Inside a hole there may be islands, with holes of
+// their own, and so on.  The places below a threshold are all inside places
+// below the next threshold up, so each contour is also inside one of the
+// contours at the next threshold up (unless it's the highest threshold).
+
+// Where a contour is in the tree of contours
+type NodeT struct {
+	parent    int   // the innermost contour at the same threshold that this one is inside, or -1
+	children  []int // the contours that this one is the parent of
+	hole      bool  // it goes round a hole, rather than round the outside of a place below the threshold
+	enclosing int   // the innermost contour at the next threshold up that this one is inside, or -1
+}
+
+// Work out how contours nest: within a threshold, and inside those at the
+// next threshold up, given by higher (which may be nil).  The nodes go with
+// the contours, in the same order, and refer to them by their index.
+func nestContours(contours, higher ContourS) []NodeT {
+	nodes := make([]NodeT, len(contours))
+	same := newContainers(contours)
+	above := newContainers(higher)
+	for i, contour := range contours {
+		probe := insidePoint(contour)
+		nodes[i].hole = contour.SignedArea() < 0
+		nodes[i].parent = same.innermost(probe, i)
+		nodes[i].enclosing = above.innermost(probe, -1)
+	}
+	for i, node := range nodes {
+		if node.parent >= 0 {
+			nodes[node.parent].children = append(nodes[node.parent].children, i)
+		}
+	}
+	return nodes
+}
+
+// A point just beside a contour, on the side that's below the threshold.
+// It's inside the contour if that's an outer boundary, and outside it if
+// it's a hole, and it's not on any other contour.
+func insidePoint(contour ContourT) Point64T {
+	a, b := contour[0], contour[1]
+	mid := lerp(a, b, 0.5)
+	d := a.Distance(b)
+	if d == 0 {
+		return mid
+	}
+	// a small step to the right of the line from a to b
+	const step = 1e-6
+	return Point64T{mid.x - (b.y-a.y)/d*step, mid.y + (b.x-a.x)/d*step}
+}
+
+// Contours, with what's needed to find the ones that a point is inside
+type containersT struct {
+	contours ContourS
+	boxes    [][4]float64
+	areas    []float64
+}
+
+func newContainers(contours ContourS) containersT {
+	ct := containersT{contours, make([][4]float64, len(contours)), make([]float64, len(contours))}
+	for i, contour := range contours {
+		ct.boxes[i] = bounds(contour)
+		ct.areas[i] = math.Abs(contour.SignedArea())
+	}
+	return ct
+}
+
+// The smallest of the contours that p is inside, other than the one numbered
+// skip, or -1 if it's not inside any of them.
+func (ct containersT) innermost(p Point64T, skip int) int {
+	best, bestArea := -1, math.Inf(1)
+	for j, contour := range ct.contours {
+		if j == skip || ct.areas[j] >= bestArea || boxDistance(p, ct.boxes[j]) > 0 || !contour.IsClosed() {
+			continue
+		}
+		if contour.Contains(p) {
+			best, bestArea = j, ct.areas[j]
+		}
+	}
+	return best
+}
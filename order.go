@@ -0,0 +1,216 @@
+// order.go -- putting paths in a good order for plotting
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"slices"
+)
+
+// Contours come out of contourFinder() in the order they're found, scanning
+// down the image, so a plotter's pen goes back and forth across the paper
+// between them.  Ordering the paths so that each starts near where the last
+// one ended cuts down the distance travelled with the pen up.
+
+// Give up on improving the order after this many passes of 2-opt
+const maxOrderPasses = 20
+
+// The distance travelled with the pen up to draw the paths in turn,
+// starting from pen, and where the pen ends up.
+func penUpDistance(paths ContourS, pen Point64T) (float64, Point64T) {
+	dist := 0.0
+	for _, path := range paths {
+		if len(path) == 0 {
+			continue
+		}
+		dist += pen.Distance(path[0])
+		pen = path[len(path)-1]
+	}
+	return dist, pen
+}
+
+// Order paths to cut down the pen-up distance: first each path is followed
+// by the nearest one (greedy nearest neighbour), then the order is improved
+// by reversing runs of paths (2-opt).  Closed paths can start at any of their
+// points, so they start at the one that's nearest to the path before.
+// If reverse is true, open paths can be drawn backwards.
+func orderPaths(paths ContourS, pen Point64T, reverse bool) ContourS {
+	ordered := nearestNeighbour(paths, pen, reverse)
+	twoOpt(ordered, pen, reverse)
+	bestStarts(ordered, pen)
+	return ordered
+}
+
+// The bounding box of a path: left, top, right, bottom
+func bounds(path ContourT) [4]float64 {
+	box := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, p := range path {
+		box[0] = math.Min(box[0], p.x)
+		box[1] = math.Min(box[1], p.y)
+		box[2] = math.Max(box[2], p.x)
+		box[3] = math.Max(box[3], p.y)
+	}
+	return box
+}
+
+// Distance from p to the nearest point of a box -- no more than the distance to any point in it
+func boxDistance(p Point64T, box [4]float64) float64 {
+	dx := max(box[0]-p.x, 0, p.x-box[2])
+	dy := max(box[1]-p.y, 0, p.y-box[3])
+	return math.Hypot(dx, dy)
+}
+
+// The point of a closed path that's nearest to p (ignoring the repeated last point)
+func nearestPoint(path ContourT, p Point64T) (int, float64) {
+	best, bestDist := 0, math.Inf(1)
+	for i, q := range path[:len(path)-1] {
+		if d := p.Distance(q); d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return best, bestDist
+}
+
+// Start a closed path at its ith point
+func rotatePath(path ContourT, i int) ContourT {
+	if i == 0 {
+		return path
+	}
+	rotated := make(ContourT, 0, len(path))
+	rotated = append(rotated, path[i:len(path)-1]...)
+	rotated = append(rotated, path[:i+1]...)
+	return rotated
+}
+
+func reversePath(path ContourT) ContourT {
+	reversed := slices.Clone(path)
+	slices.Reverse(reversed)
+	return reversed
+}
+
+// Greedy ordering: go to whichever path can be started nearest to where the pen is.
+func nearestNeighbour(paths ContourS, pen Point64T, reverse bool) ContourS {
+	ordered := make(ContourS, 0, len(paths))
+	todo := make([]int, 0, len(paths))
+	boxes := make([][4]float64, len(paths))
+	for i, path := range paths {
+		if len(path) > 0 {
+			todo = append(todo, i)
+			boxes[i] = bounds(path)
+		}
+	}
+	for len(todo) > 0 {
+		best, bestDist := -1, math.Inf(1)
+		var bestPath ContourT
+		for k, i := range todo {
+			path := paths[i]
+			if boxDistance(pen, boxes[i]) >= bestDist {
+				continue
+			}
+			if path.IsClosed() {
+				if j, d := nearestPoint(path, pen); d < bestDist {
+					best, bestDist = k, d
+					bestPath = rotatePath(path, j)
+				}
+				continue
+			}
+			if d := pen.Distance(path[0]); d < bestDist {
+				best, bestDist = k, d
+				bestPath = path
+			}
+			if d := pen.Distance(path[len(path)-1]); reverse && d < bestDist {
+				best, bestDist = k, d
+				bestPath = nil // reversed below, to save copying paths that don't get chosen
+			}
+		}
+		if bestPath == nil {
+			bestPath = reversePath(paths[todo[best]])
+		}
+		ordered = append(ordered, bestPath)
+		pen = bestPath[len(bestPath)-1]
+		todo[best] = todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+	}
+	return ordered
+}
+
+// Improve the order by reversing runs of paths, wherever that saves travel.
+// Reversing a run also reverses the open paths in it, so runs that include
+// open paths are only reversed if reverse is true.  Closed paths start and
+// end at the same point, so they're left as they are.
+func twoOpt(paths ContourS, pen Point64T, reverse bool) {
+	n := len(paths)
+	first := func(i int) Point64T { return paths[i][0] }
+	last := func(i int) Point64T { return paths[i][len(paths[i])-1] }
+	for pass := 0; pass < maxOrderPasses; pass++ {
+		improved := false
+		for i := 0; i < n; i++ {
+			prev := pen
+			if i > 0 {
+				prev = last(i - 1)
+			}
+			for j := i; j < n; j++ {
+				if !reverse && !paths[j].IsClosed() {
+					break // can't reverse this run, or any longer one
+				}
+				// before: prev -> first(i) ... last(j) -> first(j+1)
+				// after:  prev -> last(j) ... first(i) -> first(j+1)
+				delta := prev.Distance(last(j)) - prev.Distance(first(i))
+				if j+1 < n {
+					delta += first(i).Distance(first(j+1)) - last(j).Distance(first(j+1))
+				}
+				if delta < -1e-9 {
+					slices.Reverse(paths[i : j+1])
+					for k := i; k <= j; k++ {
+						if !paths[k].IsClosed() {
+							paths[k] = reversePath(paths[k])
+						}
+					}
+					improved = true
+				}
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+}
+
+// Start each closed path at the point that's nearest to both the end of
+// the path before it and the start of the one after it.
+func bestStarts(paths ContourS, pen Point64T) {
+	for i, path := range paths {
+		if !path.IsClosed() {
+			pen = path[len(path)-1]
+			continue
+		}
+		best, bestDist := 0, math.Inf(1)
+		for j, p := range path[:len(path)-1] {
+			d := pen.Distance(p)
+			if i+1 < len(paths) {
+				d += p.Distance(paths[i+1][0])
+			}
+			if d < bestDist {
+				best, bestDist = j, d
+			}
+		}
+		paths[i] = rotatePath(path, best)
+		pen = paths[i][0]
+	}
+}
@@ -0,0 +1,333 @@
+// pdf.go -- PDF output, laid out the same as the SVG
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const ptPerMM = 72 / 25.4
+
+// A single-page PDF, the same as the SVG: the paper size, margin, frame,
+// optional background image and fills, with each layer in its own optional
+// content group (OCG), so that layers can be switched on and off in a viewer.
+// The page is written in mm with y going down, then scaled like the SVG,
+// so coordinates in the content are in pixels.
+type PDFFile struct {
+	filename   string
+	content    bytes.Buffer // the page's content stream, before compression
+	objects    [][]byte     // numbered from 1
+	ocgs       []string     // names of the layers
+	opacities  []float64    // for the ExtGStates GS1, GS2, ...
+	image      []byte       // background image object, if there is one
+	thresholds []float64    // as for SVGfile.thresholds
+	colours    []string     // fill colours, as for SVGfile.colours
+	styles     []StrokeStyleT
+	clip       bool
+	cliprect   [4]float64 // x, y, width, height, in pixels
+	scale      float64
+	paper      RectangleT
+}
+
+func (pdf *PDFFile) write(s string) {
+	pdf.content.WriteString(s)
+}
+
+// Comments go in the content stream, where they're harmless.
+func (pdf *PDFFile) writeComment(s string) {
+	pdf.write("% " + strings.ReplaceAll(s, "\n", " ") + "\n")
+}
+
+func (pdf *PDFFile) open(filename string) {
+	pdf.filename = filename
+}
+
+// PDF string literal, with the awkward characters escaped
+func pdfString(s string) string {
+	r := strings.NewReplacer("\\", "\\\\", "(", "\\(", ")", "\\)")
+	return "(" + r.Replace(s) + ")"
+}
+
+// Six hex digits to a PDF colour: three numbers, 0..1
+func pdfColour(hex string) string {
+	v, _ := strconv.ParseUint(hex, 16, 32)
+	return fmt.Sprintf("%.3f %.3f %.3f", float64(v>>16)/255, float64(v>>8&0xff)/255, float64(v&0xff)/255)
+}
+
+// Add an object, returning its number
+func (pdf *PDFFile) addObject(obj []byte) int {
+	pdf.objects = append(pdf.objects, obj)
+	return len(pdf.objects)
+}
+
+// A stream object, compressed with zlib
+func pdfStream(dict string, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	if dict != "" {
+		dict += " "
+	}
+	obj := fmt.Sprintf("<< %s/Filter /FlateDecode /Length %d >>\nstream\n", dict, buf.Len())
+	return append(append([]byte(obj), buf.Bytes()...), []byte("\nendstream")...)
+}
+
+// Make the background image into an image object.  Transparent pixels are
+// blended with white.
+func (pdf *PDFFile) loadImage(path string) {
+	img, err := decodeImage(path)
+	if err != nil {
+		fmt.Printf("Can't use the background image: %s\n", err)
+		return
+	}
+	nrgba := ImageToNRGBA(img)
+	width := nrgba.Bounds().Dx()
+	height := nrgba.Bounds().Dy()
+	rgb := make([]byte, 0, width*height*3)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pix := nrgba.Pix[y*nrgba.Stride+x*4:]
+			a := int(pix[3])
+			for c := 0; c < 3; c++ {
+				rgb = append(rgb, byte((int(pix[c])*a+255*(255-a))/255))
+			}
+		}
+	}
+	pdf.image = pdfStream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8", width, height), rgb)
+}
+
+func (pdf *PDFFile) start(opts OptsT) (scale float64) {
+	pdf.paper = opts.paperSize
+	pdf.thresholds = append([]float64{0}, opts.thresholds...) // the background counts as threshold 0
+	pdf.colours = parseColours(opts.colours, len(pdf.thresholds))
+	pdf.styles = layerStyles(opts)
+	pdf.clip = opts.clip
+	placement := newPlacement(opts)
+	pdf.scale = placement.scale
+	width := float64(opts.width)
+	height := float64(opts.height)
+
+	// mm, with y going down from the top of the page
+	pdf.write(fmt.Sprintf("%.6f 0 0 %.6f 0 %.4f cm\n", ptPerMM, -ptPerMM, opts.paperSize.height*ptPerMM))
+	if opts.debug {
+		pdf.write(fmt.Sprintf("q 0 0 1 RG 0.2 w [4] 0 d 0 0 %g %g re S Q\n", opts.paperSize.width, opts.paperSize.height))
+		pdf.write(fmt.Sprintf("q 0 0.5 0 RG 0.2 w [3] 0 d %g %g %g %g re S Q\n", placement.translate.width, placement.translate.height, width*pdf.scale, height*pdf.scale))
+	}
+	// pixels, as for the SVG's main group
+	pdf.write(fmt.Sprintf("%.4f 0 0 %.4f %.4f %.4f cm\n", pdf.scale, pdf.scale, placement.translate.width, placement.translate.height))
+	pdf.write(fmt.Sprintf("0 0 0 RG %.4f w 1 J 1 j\n", opts.linewidth/pdf.scale))
+
+	clippage := 0.0
+	if opts.clip {
+		clippage = clipBox(opts, pdf.scale)[0]
+	}
+	pdf.cliprect = [4]float64{clippage, clippage, width - clippage*2, height - clippage*2}
+
+	// Background layer
+	pdf.startLayer(0, "background", len(pdf.thresholds)-1)
+	if opts.image {
+		pdf.loadImage(opts.infile)
+		if pdf.image != nil {
+			pdf.write("q\n")
+			pdf.clipPath()
+			// the image is drawn in a unit square, upside down in these coordinates
+			pdf.write(fmt.Sprintf("%g 0 0 %g 0 %g cm /Im1 Do\nQ\n", width, -height, height))
+		}
+	}
+	if len(pdf.colours) > 0 {
+		if clipBackground(opts) {
+			pdf.write(fmt.Sprintf("%.4f %.4f %.4f %.4f re f\n", pdf.cliprect[0], pdf.cliprect[1], pdf.cliprect[2], pdf.cliprect[3]))
+		} else {
+			pdf.write(fmt.Sprintf("0 0 %g %g re f\n", width, height))
+		}
+	}
+	if opts.framewidth > 0.0 {
+		fwdescaled := opts.framewidth / pdf.scale
+		w := width + fwdescaled
+		h := height + fwdescaled
+		x := -fwdescaled / 2
+		y := -fwdescaled / 2
+		if opts.clip {
+			w -= 2 * clippage
+			h -= 2 * clippage
+			x += clippage
+			y += clippage
+		}
+		pdf.write(fmt.Sprintf("q %.4f w %.4f %.4f %.4f %.4f re S Q\n", fwdescaled, x, y, w, h))
+	}
+	pdf.endLayer()
+	return pdf.scale
+}
+
+// Clip to the image, less the clippage, if clipping
+func (pdf *PDFFile) clipPath() {
+	if pdf.clip {
+		pdf.write(fmt.Sprintf("%.4f %.4f %.4f %.4f re W n\n", pdf.cliprect[0], pdf.cliprect[1], pdf.cliprect[2], pdf.cliprect[3]))
+	}
+}
+
+// Start a layer: an optional content group, with the layer's stroke style and fill colour
+func (pdf *PDFFile) startLayer(l int, label string, colourIdx int) {
+	pdf.ocgs = append(pdf.ocgs, fmt.Sprintf("%g %s", pdf.thresholds[l], label))
+	pdf.write(fmt.Sprintf("/OC /OC%d BDC\nq\n", len(pdf.ocgs)))
+	if len(pdf.colours) > 0 {
+		pdf.write(pdfColour(pdf.colours[colourIdx%len(pdf.colours)]) + " rg\n")
+	}
+	if l < len(pdf.styles) {
+		style := pdf.styles[l]
+		if style.colour != "" {
+			pdf.write(pdfColour(style.colour) + " RG\n")
+		}
+		if style.width > 0 {
+			pdf.write(fmt.Sprintf("%.4f w\n", style.width/pdf.scale))
+		}
+		if len(style.dash) > 0 {
+			dashes := make([]string, len(style.dash))
+			for i, d := range style.dash {
+				dashes[i] = fmt.Sprintf("%.4f", d/pdf.scale)
+			}
+			pdf.write(fmt.Sprintf("[%s] 0 d\n", strings.Join(dashes, " ")))
+		}
+		if style.opacity > 0 {
+			pdf.opacities = append(pdf.opacities, style.opacity)
+			pdf.write(fmt.Sprintf("/GS%d gs\n", len(pdf.opacities)))
+		}
+	}
+}
+
+func (pdf *PDFFile) endLayer() {
+	pdf.write("Q\nEMC\n")
+}
+
+func (pdf *PDFFile) path(contour ContourT) {
+	for i, p := range contour {
+		op := "l"
+		if i == 0 {
+			op = "m"
+		}
+		pdf.write(fmt.Sprintf("%.2f %.2f %s ", p.x, p.y, op))
+	}
+}
+
+// Plot a layer's paths.  When clipping, they're closed loops, and go in a
+// single clipped path, which is filled (if there are colours) and stroked;
+// if places with no data have broken some of them, the loops are filled, and
+// what's left of them is stroked.  Otherwise they're stroked one at a time.
+func (pdf *PDFFile) plotLayer(layer *LayerT) {
+	pdf.startLayer(layer.index, layer.label, layer.index-1)
+	if pdf.clip && layer.broken() {
+		pdf.clipPath()
+		if len(pdf.colours) > 0 && len(layer.fills) > 0 {
+			for _, path := range layer.fills {
+				pdf.path(path)
+				pdf.write("h\n")
+			}
+			pdf.write("f\n")
+		}
+		for _, path := range layer.paths {
+			pdf.path(path)
+			if path.IsClosed() {
+				pdf.write("h ")
+			}
+			pdf.write("S\n")
+		}
+	} else if pdf.clip {
+		pdf.clipPath()
+		for _, path := range layer.paths {
+			pdf.path(path)
+			pdf.write("h\n")
+		}
+		if len(layer.paths) > 0 {
+			if len(pdf.colours) > 0 {
+				pdf.write("B\n")
+			} else {
+				pdf.write("S\n")
+			}
+		}
+	} else {
+		for _, path := range layer.paths {
+			pdf.path(path)
+			if path.IsClosed() {
+				pdf.write("h ")
+			}
+			pdf.write("S\n")
+		}
+	}
+	pdf.endLayer()
+}
+
+func (pdf *PDFFile) stopSave() {
+	// Objects: 1 catalog, 2 pages, 3 page, 4 content, then OCGs, ExtGStates, and image
+	pdf.addObject(nil)
+	pdf.addObject(nil)
+	pdf.addObject(nil)
+	pdf.addObject(pdfStream("", pdf.content.Bytes()))
+	ocgRefs := make([]string, len(pdf.ocgs))
+	properties := make([]string, len(pdf.ocgs))
+	for i, name := range pdf.ocgs {
+		n := pdf.addObject([]byte(fmt.Sprintf("<< /Type /OCG /Name %s >>", pdfString(name))))
+		ocgRefs[i] = fmt.Sprintf("%d 0 R", n)
+		properties[i] = fmt.Sprintf("/OC%d %d 0 R", i+1, n)
+	}
+	gstates := make([]string, len(pdf.opacities))
+	for i, opacity := range pdf.opacities {
+		n := pdf.addObject([]byte(fmt.Sprintf("<< /Type /ExtGState /CA %g >>", opacity)))
+		gstates[i] = fmt.Sprintf("/GS%d %d 0 R", i+1, n)
+	}
+	resources := fmt.Sprintf("/Properties << %s >>", strings.Join(properties, " "))
+	if len(gstates) > 0 {
+		resources += fmt.Sprintf(" /ExtGState << %s >>", strings.Join(gstates, " "))
+	}
+	if pdf.image != nil {
+		resources += fmt.Sprintf(" /XObject << /Im1 %d 0 R >>", pdf.addObject(pdf.image))
+	}
+	refs := strings.Join(ocgRefs, " ")
+	pdf.objects[0] = []byte(fmt.Sprintf("<< /Type /Catalog /Pages 2 0 R /OCProperties << /OCGs [%s] /D << /Order [%s] /ON [%s] >> >> >>", refs, refs, refs))
+	pdf.objects[1] = []byte("<< /Type /Pages /Kids [3 0 R] /Count 1 >>")
+	pdf.objects[2] = []byte(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.4f %.4f] /Contents 4 0 R /Resources << %s >> >>",
+		pdf.paper.width*ptPerMM, pdf.paper.height*ptPerMM, resources))
+	info := pdf.addObject([]byte(fmt.Sprintf("<< /Title %s /Creator %s >>", pdfString(pdf.filename), pdfString(hcName+" version "+hcVersion))))
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.5\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(pdf.objects))
+	for i, obj := range pdf.objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n", i+1)
+		out.Write(obj)
+		out.WriteString("\nendobj\n")
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(pdf.objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(pdf.objects)+1, info, xref)
+	if err := os.WriteFile(pdf.filename, out.Bytes(), 0644); err != nil {
+		fmt.Printf("Unable to write PDF file %q - %s\n", pdf.filename, err)
+		os.Exit(2)
+	}
+	fmt.Printf("Created PDF file %q\n", pdf.filename)
+}
@@ -0,0 +1,270 @@
+// plotter.go -- things common to all the output formats
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// Output formats, as given by --format, and the file extensions that go with them
+var outputFormats = []string{"svg", "gcode", "hpgl", "dxf", "geojson", "pdf"}
+
+var formatExtensions = map[string]string{
+	"svg":     ".svg",
+	"gcode":   ".gcode",
+	"hpgl":    ".hpgl",
+	"dxf":     ".dxf",
+	"geojson": ".geojson",
+	"pdf":     ".pdf",
+}
+
+// A plotter writes contours to a file in one of the output formats.
+// Layers are plotted one at a time, from the highest threshold down.
+type PlotterI interface {
+	open(filename string)
+	writeComment(s string)
+	start(opts OptsT) (scale float64)
+	plotLayer(layer *LayerT)
+	stopSave()
+}
+
+func newPlotter(format string) PlotterI {
+	switch format {
+	case "gcode":
+		return new(GcodeFile)
+	case "hpgl":
+		return new(HPGLFile)
+	case "dxf":
+		return new(DXFFile)
+	case "geojson":
+		return new(GeoJSONFile)
+	case "pdf":
+		return new(PDFFile)
+	}
+	return new(SVGfile)
+}
+
+// The contours found at one threshold, and what's to be plotted for them.
+type LayerT struct {
+	index     int // as for SVGfile.thresholds: 1 for the first threshold (0 is the background)
+	threshold float64
+	label     string
+	style     StrokeStyleT
+	contours  ContourS // as traced: closed loops
+	nodes     []NodeT  // how the contours nest, indexed like them
+	paths     ContourS // what's plotted: broken at the edges of the data
+	fills     ContourS // with clip: the closed loops that are filled, which paths are broken from
+	length    float64  // of the contours, in pixels
+	points    int      // in the paths, before they're simplified
+	dropped   int      // contours left out by filterContours()
+}
+
+// Make the paths for a layer from its contours.  With clip, contours are
+// clipped to clipBox(), so that they're still closed, and fill properly
+// whether or not the plotter uses a clip path as well; those loops are the
+// fills, and the paths are the loops broken where they go along places with
+// no data.  Otherwise they're broken where they go off the image or into
+// places with no data, and the pieces may be joined up again (see joinContour()).
+// Then they're simplified, with --simplify, and smoothed, with --smooth.
+func (layer *LayerT) makePaths(hm *HeightMapT, opts OptsT) {
+	layer.paths = make(ContourS, 0, len(layer.contours))
+	layer.fills = nil
+	var box [4]float64
+	if opts.clip {
+		box = clipBox(opts, newPlacement(opts).scale)
+	}
+	for _, contour := range layer.contours {
+		if opts.clip {
+			if contour = clipPolygon(contour, box); len(contour) > 0 {
+				contour = contour.Compress()
+				layer.fills = append(layer.fills, contour)
+				layer.paths = append(layer.paths, splitContour(contour, hm)...)
+			}
+			continue
+		}
+		var paths ContourS
+		if opts.join {
+			paths = joinContour(contour, hm, opts.joinFrame)
+		} else {
+			paths = splitContour(contour, hm)
+		}
+		for _, path := range paths {
+			layer.paths = append(layer.paths, path.Compress())
+		}
+	}
+	layer.points = countPoints(layer.paths)
+	if opts.simplify > 0 {
+		layer.simplifyPaths(opts)
+	}
+	if opts.smooth != "" {
+		layer.smoothPaths(opts)
+	}
+}
+
+// Whether any of a layer's paths have been broken where they go along places
+// with no data, with clip, so that they can't be filled as they are.
+func (layer *LayerT) broken() bool {
+	if len(layer.paths) != len(layer.fills) {
+		return true
+	}
+	for _, path := range layer.paths {
+		if !path.IsClosed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Create a file for a plotter, giving up if that's not possible.
+func createFile(filename string) *os.File {
+	fh, err := os.Create(filename)
+	if err != nil {
+		log.Fatalf("Unable to open output file %q - %s", filename, err)
+	}
+	return fh
+}
+
+// Where the image goes on the paper, as worked out by calcSizes():
+// pixel coordinates are scaled, then translated, to give millimetres
+// from the top left of the paper.
+type PlacementT struct {
+	translate RectangleT
+	scale     float64
+}
+
+func newPlacement(opts OptsT) PlacementT {
+	translate, scale := calcSizes(RectangleT{float64(opts.width), float64(opts.height)}, opts.margin, opts.paperSize, opts.framewidth)
+	return PlacementT{translate, scale}
+}
+
+func (pl PlacementT) toPaper(p Point64T) Point64T {
+	return Point64T{pl.translate.width + p.x*pl.scale, pl.translate.height + p.y*pl.scale}
+}
+
+// The centre line of the frame, in mm on the paper, as a closed loop
+// starting at the top left.  Matches the frame drawn by SVGfile.start().
+func (pl PlacementT) frame(opts OptsT) ContourT {
+	offset := opts.framewidth / 2
+	if opts.clip {
+		offset -= opts.linewidth/2 + opts.clipInset
+	}
+	topLeft := pl.toPaper(Point64T{0, 0})
+	bottomRight := pl.toPaper(Point64T{float64(opts.width), float64(opts.height)})
+	left := topLeft.x - offset
+	top := topLeft.y - offset
+	right := bottomRight.x + offset
+	bottom := bottomRight.y + offset
+	return ContourT{{left, top}, {right, top}, {right, bottom}, {left, bottom}, {left, top}}
+}
+
+func (pl PlacementT) String() string {
+	return fmt.Sprintf("translate %v scale %.4f", pl.translate, pl.scale)
+}
+
+// 'off the image' includes contours around shapes that hit the edge.
+// Because values have already been increased by 0.5 (in PointWeightedAvg()),
+// choose anything here that's within 1 pixel of the edge.
+// FIXME limit is now 0.0
+func offImage(p Point64T, width, height int) bool {
+	const limit = 0.0 //1.0
+	if p.x < limit || p.y < limit || p.x > float64(width)-limit || p.y > float64(height)-limit {
+		return true
+	}
+	return false
+}
+
+// Points just inside pixels with no data count as being off the image.
+// (Pieces of contours end at such points, which are right at the boundary.)
+func offData(p Point64T, hm *HeightMapT) bool {
+	if offImage(p, hm.width, hm.height) {
+		return true
+	}
+	return hm.noData(min(int(p.x), hm.width-1), min(int(p.y), hm.height-1))
+}
+
+// Split a contour where it goes off the edge of the image, or into places
+// with no data.  A contour that stays on the image is returned whole, still
+// closed, so that it can become a polygon; otherwise the pieces are open.
+func splitContour(contour ContourT, hm *HeightMapT) ContourS {
+	var paths ContourS
+	for _, piece := range splitPieces(contour, hm) {
+		paths = append(paths, piece.path)
+	}
+	return paths
+}
+
+// A piece of a contour that's been split, and where it came from in the contour.
+type PieceT struct {
+	path  ContourT
+	first int // index in the contour of the first point that's on the data
+	last  int // and of the last one
+}
+
+// Pieces are clipped to the edge of the image, so that a piece ends exactly
+// where the contour crosses it, even if it goes over a corner.  A line that
+// goes from off the image to off it again is left out, even if it cuts across
+// a corner: both its ends come from the padding round the image, so it just
+// goes round the corner pixel.  Pieces that are broken by places with no data
+// end at the last point that's on the data, or the first point that isn't.
+func splitPieces(contour ContourT, hm *HeightMapT) []PieceT {
+	var pieces []PieceT
+	box := imageBox(hm.width, hm.height)
+	var piece PieceT // may not be the whole contour
+	lineOpen := false
+	if len(contour) > 0 && !offData(contour[0], hm) {
+		piece = PieceT{path: ContourT{contour[0]}, first: 0}
+		lineOpen = true
+	}
+	for i := 1; i < len(contour); i++ {
+		prev, p := contour[i-1], contour[i]
+		if !offData(p, hm) {
+			if !lineOpen {
+				// start a new line -- on the edge, or at the edge of the data
+				start := prev
+				if offImage(prev, hm.width, hm.height) {
+					start, _, _ = clipSegment(prev, p, box)
+				}
+				piece = PieceT{path: ContourT{start}, first: i}
+				lineOpen = true
+			}
+			piece.path = append(piece.path, p)
+			continue
+		}
+		if lineOpen {
+			// stop the line -- on the edge, or at the edge of the data
+			end := p
+			if offImage(p, hm.width, hm.height) {
+				_, end, _ = clipSegment(prev, p, box)
+			}
+			piece.path = append(piece.path, end)
+			piece.last = i - 1
+			pieces = append(pieces, piece)
+			lineOpen = false
+			continue
+		}
+	}
+	if lineOpen {
+		// stop the line
+		piece.last = len(contour) - 1
+		pieces = append(pieces, piece)
+	}
+	return pieces
+}
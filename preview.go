@@ -0,0 +1,421 @@
+// preview.go -- PNG previews, drawn without any external tools
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// A raster accumulates the signed area covered by closed shapes, one row
+// after another, so that (anti-aliased) coverage comes from a running sum.
+// Shapes that overlap going the same way round are merged; ones that go
+// opposite ways cancel out, which makes holes -- like SVG's nonzero fill rule.
+type rasterT struct {
+	width, height int
+	acc           []float64
+}
+
+func newRaster(width, height int) *rasterT {
+	// room for an extra pixel or two off the end of the last row
+	return &rasterT{width: width, height: height, acc: make([]float64, width*height+3)}
+}
+
+func (r *rasterT) clear() {
+	clear(r.acc)
+}
+
+// Add a line to the raster.  Points are in pixels; anything off the left
+// or right side is treated as being on it.
+func (r *rasterT) line(p0, p1 Point64T) {
+	if p0.y == p1.y {
+		return
+	}
+	dir := 1.0
+	if p0.y > p1.y {
+		dir = -1
+		p0, p1 = p1, p0
+	}
+	dxdy := (p1.x - p0.x) / (p1.y - p0.y)
+	x := p0.x
+	if p0.y < 0 {
+		x -= p0.y * dxdy
+	}
+	w := float64(r.width)
+	yEnd := min(r.height, int(math.Ceil(p1.y)))
+	for y := max(0, int(p0.y)); y < yEnd; y++ {
+		rowStart := y * r.width
+		dy := math.Min(float64(y+1), p1.y) - math.Max(float64(y), p0.y)
+		xNext := x + dxdy*dy
+		d := dy * dir
+		x0 := math.Min(math.Max(math.Min(x, xNext), 0), w)
+		x1 := math.Min(math.Max(math.Max(x, xNext), 0), w)
+		x0floor := math.Floor(x0)
+		x0i := int(x0floor)
+		x1ceil := math.Ceil(x1)
+		x1i := int(x1ceil)
+		if x1i <= x0i+1 {
+			xmf := 0.5*(x0+x1) - x0floor
+			r.acc[rowStart+x0i] += d - d*xmf
+			r.acc[rowStart+x0i+1] += d * xmf
+		} else {
+			s := 1 / (x1 - x0)
+			x0f := x0 - x0floor
+			a0 := 0.5 * s * (1 - x0f) * (1 - x0f)
+			x1f := x1 - x1ceil + 1
+			am := 0.5 * s * x1f * x1f
+			r.acc[rowStart+x0i] += d * a0
+			if x1i == x0i+2 {
+				r.acc[rowStart+x0i+1] += d * (1 - a0 - am)
+			} else {
+				a1 := s * (1.5 - x0f)
+				r.acc[rowStart+x0i+1] += d * (a1 - a0)
+				for xi := x0i + 2; xi < x1i-1; xi++ {
+					r.acc[rowStart+xi] += d * s
+				}
+				a2 := a1 + float64(x1i-x0i-3)*s
+				r.acc[rowStart+x1i-1] += d * (1 - a2 - am)
+			}
+			r.acc[rowStart+x1i] += d * am
+		}
+		x = xNext
+	}
+}
+
+// Add a closed shape to the raster
+func (r *rasterT) polygon(c ContourT) {
+	for i := range c {
+		r.line(c[i], c[(i+1)%len(c)])
+	}
+}
+
+// Add a shape that goes the same way round as all the others, so that they merge
+func (r *rasterT) positive(c ContourT) {
+	if c.SignedArea() < 0 {
+		for i := len(c) - 1; i >= 0; i-- {
+			r.line(c[i], c[(i+len(c)-1)%len(c)])
+		}
+		return
+	}
+	r.polygon(c)
+}
+
+// Add a line of the given width along a path, with round ends and joins.
+func (r *rasterT) stroke(path ContourT, width float64) {
+	radius := width / 2
+	sides := max(8, min(64, int(radius*4)))
+	circle := make(ContourT, sides)
+	for i, p := range path {
+		for j := range circle {
+			angle := 2 * math.Pi * float64(j) / float64(sides)
+			circle[j] = Point64T{p.x + radius*math.Cos(angle), p.y + radius*math.Sin(angle)}
+		}
+		r.positive(circle)
+		if i == 0 {
+			continue
+		}
+		q := path[i-1]
+		length := p.Distance(q)
+		if length == 0 {
+			continue
+		}
+		nx := (q.y - p.y) / length * radius
+		ny := (p.x - q.x) / length * radius
+		r.positive(ContourT{{q.x + nx, q.y + ny}, {p.x + nx, p.y + ny}, {p.x - nx, p.y - ny}, {q.x - nx, q.y - ny}})
+	}
+}
+
+// Turn the accumulated areas into coverage, 0..1, for each pixel.
+func (r *rasterT) coverage() []float64 {
+	cover := make([]float64, r.width*r.height)
+	sum := 0.0
+	for i := range cover {
+		sum += r.acc[i]
+		cover[i] = math.Min(math.Abs(sum), 1)
+	}
+	return cover
+}
+
+// Split a path into dashes; lengths are in the same units as the path.
+func dashPath(path ContourT, dash []float64) ContourS {
+	total := 0.0
+	for _, d := range dash {
+		total += d
+	}
+	if total <= 0 {
+		return ContourS{path}
+	}
+	if len(dash)%2 == 1 {
+		// an odd number of lengths is repeated, as in SVG
+		dash = append(dash, dash...)
+	}
+	var dashes ContourS
+	var current ContourT
+	k := 0          // which dash or gap
+	left := dash[0] // how much of it is left
+	for i := 1; i < len(path); i++ {
+		p := path[i-1]
+		q := path[i]
+		length := p.Distance(q)
+		done := 0.0
+		for done < length {
+			step := math.Min(left, length-done)
+			a := Point64T{p.x + (q.x-p.x)*done/length, p.y + (q.y-p.y)*done/length}
+			b := Point64T{p.x + (q.x-p.x)*(done+step)/length, p.y + (q.y-p.y)*(done+step)/length}
+			if k%2 == 0 {
+				if len(current) == 0 {
+					current = append(current, a)
+				}
+				current = append(current, b)
+			}
+			done += step
+			left -= step
+			if left <= 0 {
+				if k%2 == 0 && len(current) > 0 {
+					dashes = append(dashes, current)
+					current = nil
+				}
+				k = (k + 1) % len(dash)
+				left = dash[k]
+			}
+		}
+	}
+	if len(current) > 0 {
+		dashes = append(dashes, current)
+	}
+	return dashes
+}
+
+// A PNG preview of the output: white paper, with the (optional) background
+// image, fills, frame, and contours drawn as they'd look in the SVG.
+type PreviewFile struct {
+	filename   string
+	img        *image.NRGBA
+	raster     *rasterT
+	placement  PlacementT
+	pxPerMM    float64
+	linewidth  float64 // in pixels
+	clip       bool
+	cliprect   [4]float64 // left, top, right, bottom, in pixels
+	curves     bool       // make the paths into curves, as the plotter does
+	frame      [4]float64 // where curves are pinned, as smoothFrame()
+	thresholds []float64
+	colours    []string
+	styles     []StrokeStyleT
+}
+
+// Previews don't have comments
+func (pv *PreviewFile) writeComment(s string) {
+}
+
+func (pv *PreviewFile) open(filename string) {
+	pv.filename = filename
+}
+
+// Convert a point in the image to pixels in the preview
+func (pv *PreviewFile) toPreview(p Point64T) Point64T {
+	p = pv.placement.toPaper(p)
+	return Point64T{p.x * pv.pxPerMM, p.y * pv.pxPerMM}
+}
+
+func (pv *PreviewFile) toPreviewPath(path ContourT) ContourT {
+	out := make(ContourT, len(path))
+	for i, p := range path {
+		out[i] = pv.toPreview(p)
+	}
+	return out
+}
+
+func hexToNRGBA(hex string) color.NRGBA {
+	v, _ := strconv.ParseUint(hex, 16, 32)
+	return color.NRGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}
+}
+
+// How much of the pixel at x,y is inside the clip rectangle
+func (pv *PreviewFile) clipCoverage(x, y int) float64 {
+	overlap := func(lo, hi float64, i int) float64 {
+		return math.Max(0, math.Min(hi, float64(i+1))-math.Max(lo, float64(i)))
+	}
+	return overlap(pv.cliprect[0], pv.cliprect[2], x) * overlap(pv.cliprect[1], pv.cliprect[3], y)
+}
+
+// Paint what's in the raster onto the image, then clear the raster.
+func (pv *PreviewFile) paint(c color.NRGBA, opacity float64, clip bool) {
+	cover := pv.raster.coverage()
+	pv.raster.clear()
+	bounds := pv.img.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			alpha := cover[x+y*bounds.Dx()] * opacity
+			if alpha == 0 {
+				continue
+			}
+			if clip {
+				alpha *= pv.clipCoverage(x, y)
+			}
+			pix := pv.img.Pix[y*pv.img.Stride+x*4:]
+			pix[0] = uint8(math.Round(float64(pix[0])*(1-alpha) + float64(c.R)*alpha))
+			pix[1] = uint8(math.Round(float64(pix[1])*(1-alpha) + float64(c.G)*alpha))
+			pix[2] = uint8(math.Round(float64(pix[2])*(1-alpha) + float64(c.B)*alpha))
+		}
+	}
+}
+
+// Draw the input image in its place, blended with the paper where it's transparent.
+func (pv *PreviewFile) drawImage(path string, opts OptsT) {
+	src, err := decodeImage(path)
+	if err != nil {
+		fmt.Printf("Can't use the background image: %s\n", err)
+		return
+	}
+	nrgba := ImageToNRGBA(src)
+	topLeft := pv.toPreview(Point64T{0, 0})
+	bottomRight := pv.toPreview(Point64T{float64(opts.width), float64(opts.height)})
+	if pv.clip {
+		topLeft = Point64T{pv.cliprect[0], pv.cliprect[1]}
+		bottomRight = Point64T{pv.cliprect[2], pv.cliprect[3]}
+	}
+	bounds := pv.img.Bounds()
+	for y := max(0, int(topLeft.y)); y < min(bounds.Dy(), int(math.Ceil(bottomRight.y))); y++ {
+		for x := max(0, int(topLeft.x)); x < min(bounds.Dx(), int(math.Ceil(bottomRight.x))); x++ {
+			// nearest pixel in the input image
+			sx := int((float64(x) + 0.5 - pv.placement.translate.width*pv.pxPerMM) / (pv.placement.scale * pv.pxPerMM))
+			sy := int((float64(y) + 0.5 - pv.placement.translate.height*pv.pxPerMM) / (pv.placement.scale * pv.pxPerMM))
+			if sx < 0 || sy < 0 || sx >= nrgba.Bounds().Dx() || sy >= nrgba.Bounds().Dy() {
+				continue
+			}
+			s := nrgba.Pix[sy*nrgba.Stride+sx*4:]
+			d := pv.img.Pix[y*pv.img.Stride+x*4:]
+			alpha := float64(s[3]) / 0xff
+			for c := 0; c < 3; c++ {
+				d[c] = uint8(math.Round(float64(d[c])*(1-alpha) + float64(s[c])*alpha))
+			}
+		}
+	}
+}
+
+func (pv *PreviewFile) start(opts OptsT) (scale float64) {
+	pv.placement = newPlacement(opts)
+	pv.pxPerMM = opts.previewDPI / 25.4
+	width := int(math.Round(opts.paperSize.width * pv.pxPerMM))
+	height := int(math.Round(opts.paperSize.height * pv.pxPerMM))
+	pv.img = image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := range pv.img.Pix {
+		pv.img.Pix[i] = 0xff // white paper
+	}
+	pv.raster = newRaster(width, height)
+	pv.linewidth = opts.linewidth * pv.pxPerMM
+	pv.thresholds = append([]float64{0}, opts.thresholds...)
+	pv.colours = parseColours(opts.colours, len(pv.thresholds))
+	pv.styles = layerStyles(opts)
+	pv.clip = opts.clip
+	// with --smooth curve, the plotter draws curves that the paths don't have yet
+	pv.curves = opts.smooth == "curve" && slices.Contains(curveFormats, opts.format)
+	pv.frame = smoothFrame(opts)
+	clippage := 0.0
+	if opts.clip {
+		clippage = clipBox(opts, pv.placement.scale)[0]
+	}
+	topLeft := pv.toPreview(Point64T{clippage, clippage})
+	bottomRight := pv.toPreview(Point64T{float64(opts.width) - clippage, float64(opts.height) - clippage})
+	pv.cliprect = [4]float64{topLeft.x, topLeft.y, bottomRight.x, bottomRight.y}
+
+	// The background layer
+	if opts.image {
+		pv.drawImage(opts.infile, opts)
+	}
+	if len(pv.colours) > 0 {
+		pv.raster.polygon(pv.toPreviewPath(ContourT{{0, 0}, {float64(opts.width), 0}, {float64(opts.width), float64(opts.height)}, {0, float64(opts.height)}}))
+		pv.paint(hexToNRGBA(pv.colours[(len(pv.thresholds)-1)%len(pv.colours)]), 1, clipBackground(opts))
+	}
+	if opts.framewidth > 0.0 {
+		frame := pv.placement.frame(opts)
+		for i := range frame {
+			frame[i] = Point64T{frame[i].x * pv.pxPerMM, frame[i].y * pv.pxPerMM}
+		}
+		// square corners, like the SVG's rect
+		fw := opts.framewidth * pv.pxPerMM / 2
+		outer := ContourT{{frame[0].x - fw, frame[0].y - fw}, {frame[1].x + fw, frame[1].y - fw}, {frame[2].x + fw, frame[2].y + fw}, {frame[3].x - fw, frame[3].y + fw}}
+		inner := ContourT{{frame[0].x + fw, frame[0].y + fw}, {frame[3].x + fw, frame[3].y - fw}, {frame[2].x - fw, frame[2].y - fw}, {frame[1].x - fw, frame[1].y + fw}}
+		pv.raster.polygon(outer)
+		pv.raster.polygon(inner)
+		pv.paint(color.NRGBA{0, 0, 0, 0xff}, 1, false)
+	}
+	return pv.placement.scale
+}
+
+func (pv *PreviewFile) plotLayer(layer *LayerT) {
+	style := pv.styles[layer.index]
+	paths := make(ContourS, len(layer.paths))
+	for i, path := range layer.paths {
+		if pv.curves {
+			path = flattenCurve(path, pv.frame)
+		}
+		paths[i] = pv.toPreviewPath(path)
+	}
+	if pv.clip && len(pv.colours) > 0 {
+		for _, path := range layer.fills {
+			if pv.curves {
+				path = flattenCurve(path, pv.frame)
+			}
+			pv.raster.polygon(pv.toPreviewPath(path))
+		}
+		pv.paint(hexToNRGBA(pv.colours[(layer.index-1)%len(pv.colours)]), 1, true)
+	}
+	stroke := color.NRGBA{0, 0, 0, 0xff}
+	if style.colour != "" {
+		stroke = hexToNRGBA(style.colour)
+	}
+	width := pv.linewidth
+	if style.width > 0 {
+		width = style.width * pv.pxPerMM
+	}
+	opacity := 1.0
+	if style.opacity > 0 {
+		opacity = style.opacity
+	}
+	dash := make([]float64, len(style.dash))
+	for i, d := range style.dash {
+		dash[i] = d * pv.pxPerMM
+	}
+	for _, path := range paths {
+		if len(dash) > 0 {
+			for _, d := range dashPath(path, dash) {
+				pv.raster.stroke(d, width)
+			}
+		} else {
+			pv.raster.stroke(path, width)
+		}
+	}
+	pv.paint(stroke, opacity, pv.clip)
+}
+
+func (pv *PreviewFile) stopSave() {
+	fh := createFile(pv.filename)
+	if err := png.Encode(fh, pv.img); err != nil {
+		fmt.Printf("Unable to write preview %q - %s\n", pv.filename, err)
+	}
+	fh.Close()
+	fmt.Printf("Created preview %q\n", pv.filename)
+}
@@ -0,0 +1,387 @@
+// readers.go -- reading height maps from files that aren't images
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Input formats, as given by --input-format
+var inputFormats = []string{"auto", "image", "asc", "csv", "hgt", "geotiff"}
+
+// Work out the input format from the file's extension, unless it's been given explicitly.
+func resolveInputFormat(path, format string) string {
+	if format != "" && format != "auto" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".asc":
+		return "asc"
+	case ".csv":
+		return "csv"
+	case ".hgt":
+		return "hgt"
+	case ".tif", ".tiff":
+		return "geotiff"
+	}
+	return "image"
+}
+
+// loadHeightMap loads a height map from an image or grid file.
+// Images keep their nominal range of values (e.g. 0..255), but grids
+// use the range of the values they actually contain.
+func loadHeightMap(opts OptsT) (*HeightMapT, int, int, error) {
+	var hm *HeightMapT
+	var err error
+	path := opts.infile
+	switch resolveInputFormat(path, opts.inputFormat) {
+	case "asc":
+		hm, err = loadASCGrid(path)
+	case "csv":
+		hm, err = loadCSVGrid(path)
+	case "hgt":
+		hm, err = loadHGT(path)
+	case "geotiff":
+		hm, err = loadGeoTIFF(path)
+	default:
+		img, err := decodeImage(path)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		ch := defaultChannel
+		if opts.channel != "" {
+			ch, err = parseChannel(opts.channel)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+		}
+		hm = imageToHeightMap(img, ch)
+		if hm.geo, err = loadWorldFile(path); err != nil {
+			return nil, 0, 0, err
+		}
+		if opts.nodataSet {
+			hm.setNoData(opts.nodata)
+		}
+		if ch.name != "alpha" {
+			// Transparent pixels have no data
+			hm.maskImage(img, opts.alphaCutoff, false)
+		}
+		if err := loadMask(hm, opts); err != nil {
+			return nil, 0, 0, err
+		}
+		low, high := hm.valueRange()
+		if low > high {
+			return nil, 0, 0, fmt.Errorf("no data in image: %s", path)
+		}
+		if ch.decodes() {
+			// real heights -- use the range of what's left after masking
+			hm.low, hm.high = low, high
+		}
+		if opts.invert {
+			hm.invert()
+		}
+		if len(opts.valueRange) == 2 {
+			hm.mapValues(opts.valueRange[0], opts.valueRange[1])
+		}
+		return hm, hm.width, hm.height, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if hm.geo == nil {
+		if hm.geo, err = loadWorldFile(path); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	if opts.nodataSet {
+		hm.setNoData(opts.nodata)
+	}
+	if err := loadMask(hm, opts); err != nil {
+		return nil, 0, 0, err
+	}
+	hm.low, hm.high = hm.valueRange()
+	if hm.low > hm.high {
+		return nil, 0, 0, fmt.Errorf("no data in grid: %s", path)
+	}
+	if opts.invert {
+		hm.invert()
+	}
+	if len(opts.valueRange) == 2 {
+		hm.mapValues(opts.valueRange[0], opts.valueRange[1])
+	}
+	return hm, hm.width, hm.height, nil
+}
+
+// The most values a grid can have, so that a mistake in a header doesn't use up all the memory
+const maxGridValues = 1 << 28
+
+// ESRI ASCII grid, e.g.
+//
+//	ncols        4
+//	nrows        3
+//	xllcorner    385000.0
+//	yllcorner    804000.0
+//	cellsize     50.0
+//	NODATA_value -9999
+//	12.5 13.0 -9999 15.5
+//	...
+//
+// xllcenter and yllcenter may be used instead of the corners; NODATA_value is optional.
+// There must be exactly ncols x nrows values.
+func loadASCGrid(path string) (*HeightMapT, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input grid: %s, %s", path, err)
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	scanner.Split(bufio.ScanWords)
+	header := make(map[string]float64)
+	word := ""
+	for scanner.Scan() {
+		word = scanner.Text()
+		if _, err := strconv.ParseFloat(word, 64); err == nil {
+			// first data value
+			break
+		}
+		key := strings.ToLower(word)
+		if !scanner.Scan() {
+			return nil, fmt.Errorf("missing value for %s in grid header: %s", word, path)
+		}
+		value, err := strconv.ParseFloat(scanner.Text(), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s in grid header: %s, %s", word, path, err)
+		}
+		header[key] = value
+		word = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read input grid: %s, %s", path, err)
+	}
+	for _, key := range []string{"ncols", "nrows", "cellsize"} {
+		if _, ok := header[key]; !ok {
+			return nil, fmt.Errorf("missing %s in grid header: %s", key, path)
+		}
+	}
+	ncols, nrows := header["ncols"], header["nrows"]
+	if ncols < 1 || nrows < 1 || ncols != math.Trunc(ncols) || nrows != math.Trunc(nrows) || ncols*nrows > maxGridValues {
+		return nil, fmt.Errorf("invalid grid size %g x %g: %s", ncols, nrows, path)
+	}
+	width, height := int(ncols), int(nrows)
+	hm := newHeightMap(width, height)
+	nodata, hasNodata := header["nodata_value"]
+	for i := range hm.values {
+		if word == "" {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return nil, fmt.Errorf("failed to read input grid: %s, %s", path, err)
+				}
+				return nil, fmt.Errorf("grid has %d values, expected %d: %s", i, width*height, path)
+			}
+			word = scanner.Text()
+		}
+		v, err := strconv.ParseFloat(word, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid grid value '%s': %s", word, path)
+		}
+		if hasNodata && v == nodata {
+			v = math.NaN()
+		}
+		hm.values[i] = v
+		word = ""
+	}
+	if scanner.Scan() {
+		return nil, fmt.Errorf("grid has more than %d values: %s", width*height, path)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read input grid: %s, %s", path, err)
+	}
+	cellsize := header["cellsize"]
+	left, ok := header["xllcorner"]
+	if !ok {
+		centre, ok := header["xllcenter"]
+		if !ok {
+			return nil, fmt.Errorf("missing xllcorner or xllcenter in grid header: %s", path)
+		}
+		left = centre - cellsize/2
+	}
+	bottom, ok := header["yllcorner"]
+	if !ok {
+		centre, ok := header["yllcenter"]
+		if !ok {
+			return nil, fmt.Errorf("missing yllcorner or yllcenter in grid header: %s", path)
+		}
+		bottom = centre - cellsize/2
+	}
+	hm.geo = &GeoRefT{a: cellsize, e: -cellsize, c: left, f: bottom + float64(height)*cellsize}
+	return hm, nil
+}
+
+// Comma-separated grid of values, one row per line, starting at the top.
+// Empty cells, and those containing 'NaN' or 'NA', have no data.
+func loadCSVGrid(path string) (*HeightMapT, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input grid: %s, %s", path, err)
+	}
+	defer fh.Close()
+	reader := csv.NewReader(fh)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	var rows [][]float64
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read input grid: %s, %s", path, err)
+		}
+		row := make([]float64, len(record))
+		for i, field := range record {
+			field = strings.TrimSpace(field)
+			if field == "" || strings.EqualFold(field, "NA") {
+				row[i] = math.NaN()
+				continue
+			}
+			row[i], err = strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid grid value '%s' in row %d: %s", field, len(rows)+1, path)
+			}
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no values in grid: %s", path)
+	}
+	hm := newHeightMap(len(rows[0]), len(rows))
+	for y, row := range rows {
+		copy(hm.values[y*hm.width:], row)
+	}
+	return hm, nil
+}
+
+// SRTM tiles: a square grid of big-endian 16-bit signed integers,
+// 1201 or 3601 samples across, with -32768 for voids.
+// The name of the file gives the latitude and longitude of the bottom-left
+// corner, e.g. N51W002.hgt; the samples lie on the tile's edges, so the
+// outside pixels overlap those of neighbouring tiles.
+func loadHGT(path string) (*HeightMapT, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input tile: %s, %s", path, err)
+	}
+	size := int(math.Round(math.Sqrt(float64(len(buf) / 2))))
+	if size < 2 || size*size*2 != len(buf) {
+		return nil, fmt.Errorf("tile is not a square grid of 16-bit values: %s", path)
+	}
+	hm := newHeightMap(size, size)
+	hm.integral = true
+	for i := range hm.values {
+		v := int16(binary.BigEndian.Uint16(buf[i*2:]))
+		if v == -32768 {
+			hm.values[i] = math.NaN()
+		} else {
+			hm.values[i] = float64(v)
+		}
+	}
+	// Georeference from the file name, if it follows the usual pattern
+	hgtName := regexp.MustCompile(`(?i:^([NS])(\d{1,2})([EW])(\d{1,3}))`)
+	if m := hgtName.FindStringSubmatch(filepath.Base(path)); m != nil {
+		lat, _ := strconv.ParseFloat(m[2], 64)
+		lon, _ := strconv.ParseFloat(m[4], 64)
+		if strings.EqualFold(m[1], "S") {
+			lat = -lat
+		}
+		if strings.EqualFold(m[3], "W") {
+			lon = -lon
+		}
+		cellsize := 1 / float64(size-1)
+		hm.geo = &GeoRefT{a: cellsize, e: -cellsize, c: lon - cellsize/2, f: lat + 1 + cellsize/2}
+	}
+	return hm, nil
+}
+
+// Apply the mask image given by --mask, if any.
+func loadMask(hm *HeightMapT, opts OptsT) error {
+	if opts.mask == "" {
+		return nil
+	}
+	maskImg, err := decodeImage(opts.mask)
+	if err != nil {
+		return err
+	}
+	if maskImg.Bounds().Dx() != hm.width || maskImg.Bounds().Dy() != hm.height {
+		return fmt.Errorf("mask %s is %d x %d, but the input is %d x %d", opts.mask, maskImg.Bounds().Dx(), maskImg.Bounds().Dy(), hm.width, hm.height)
+	}
+	hm.maskImage(maskImg, opts.alphaCutoff, true)
+	return nil
+}
+
+// Possible names for the world file that goes with an image or raster,
+// e.g. for beach.png: beach.pgw, beach.pngw, or beach.wld
+func worldFileNames(path string) []string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	names := make([]string, 0, 3)
+	if len(ext) >= 3 {
+		names = append(names, base+ext[:2]+ext[len(ext)-1:]+"w")
+	}
+	return append(names, base+ext+"w", base+".wld")
+}
+
+// Read the world file that goes with an image or raster, if there is one.
+// A world file has six lines: A, D, B, E, C, F, where C and F are the
+// real-world coordinates of the centre of the top-left pixel.
+// Returns nil if there's no world file.
+func loadWorldFile(path string) (*GeoRefT, error) {
+	for _, name := range worldFileNames(path) {
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(buf))
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("world file should have 6 values, not %d: %s", len(fields), name)
+		}
+		var v [6]float64
+		for i, field := range fields {
+			v[i], err = strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value '%s' in world file: %s", field, name)
+			}
+		}
+		geo := GeoRefT{a: v[0], d: v[1], b: v[2], e: v[3], c: v[4], f: v[5]}
+		// move from the centre of the pixel to its corner
+		geo.c -= (geo.a + geo.b) / 2
+		geo.f -= (geo.d + geo.e) / 2
+		return &geo, nil
+	}
+	return nil, nil
+}
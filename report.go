@@ -0,0 +1,149 @@
+// report.go -- statistics about the contours found at each threshold
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// With --report, the contours at each threshold are summed up, as a table,
+// or as JSON if the report's file name ends in '.json'.  Lengths and areas
+// are on the paper, in mm and mm², with areas in pixels as well.
+
+// Statistics for the contours at one threshold, or for all of them
+type LevelReportT struct {
+	Threshold        float64 `json:"threshold"`
+	Label            string  `json:"label"`
+	Contours         int     `json:"contours"`
+	Holes            int     `json:"holes"`
+	Dropped          int     `json:"dropped"`          // by --min-length, --min-area, and --max-count
+	Area             float64 `json:"area"`             // mm², inside outer boundaries less holes
+	AreaPixels       float64 `json:"areaPixels"`       // the same, in pixels
+	Length           float64 `json:"length"`           // mm, of all the contours
+	MinLength        float64 `json:"minLength"`        // mm
+	MaxLength        float64 `json:"maxLength"`        // mm, of the longest contour
+	MeanLength       float64 `json:"meanLength"`       // mm
+	Points           int     `json:"points"`           // as traced
+	CompressedPoints int     `json:"compressedPoints"` // after Compress()
+	PlottedPoints    int     `json:"plottedPoints"`    // after simplifying and smoothing
+}
+
+type ReportT struct {
+	Input  string         `json:"input"`
+	Scale  float64        `json:"scale"`  // mm on the paper for each pixel
+	Levels []LevelReportT `json:"levels"` // from the lowest threshold up
+	Total  LevelReportT   `json:"total"`
+}
+
+// Sum up a layer, once its paths have been made.  scale is the size of a pixel on the paper, in mm.
+func levelReport(layer *LayerT, scale float64) LevelReportT {
+	lr := LevelReportT{
+		Threshold:        layer.threshold,
+		Label:            layer.label,
+		Contours:         len(layer.contours),
+		Dropped:          layer.dropped,
+		Points:           countPoints(layer.contours),
+		CompressedPoints: layer.points,
+		PlottedPoints:    countPoints(layer.paths),
+	}
+	for i, contour := range layer.contours {
+		if layer.nodes[i].hole {
+			lr.Holes++
+		}
+		lr.AreaPixels += contour.SignedArea()
+		length := contour.Length() * scale
+		lr.Length += length
+		if i == 0 || length < lr.MinLength {
+			lr.MinLength = length
+		}
+		lr.MaxLength = math.Max(lr.MaxLength, length)
+	}
+	lr.Area = lr.AreaPixels * scale * scale
+	if lr.Contours > 0 {
+		lr.MeanLength = lr.Length / float64(lr.Contours)
+	}
+	return lr
+}
+
+// Sum up all the levels
+func totalReport(levels []LevelReportT) LevelReportT {
+	total := LevelReportT{Label: "total"}
+	for _, lr := range levels {
+		if lr.Contours > 0 && (total.Contours == 0 || lr.MinLength < total.MinLength) {
+			total.MinLength = lr.MinLength
+		}
+		total.Contours += lr.Contours
+		total.Holes += lr.Holes
+		total.Dropped += lr.Dropped
+		total.Area += lr.Area
+		total.AreaPixels += lr.AreaPixels
+		total.Length += lr.Length
+		total.MaxLength = math.Max(total.MaxLength, lr.MaxLength)
+		total.Points += lr.Points
+		total.CompressedPoints += lr.CompressedPoints
+		total.PlottedPoints += lr.PlottedPoints
+	}
+	if total.Contours > 0 {
+		total.MeanLength = total.Length / float64(total.Contours)
+	}
+	return total
+}
+
+// Write the report to a file, or to standard output if the name is '-'.
+func (report ReportT) save(filename string) {
+	var w io.Writer = os.Stdout
+	if filename != "-" {
+		fh := createFile(filename)
+		defer fh.Close()
+		w = fh
+	}
+	if strings.HasSuffix(strings.ToLower(filename), ".json") {
+		js, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			panic(fmt.Sprintf("ReportT.save: can't encode report: %s", err))
+		}
+		fmt.Fprintf(w, "%s\n", js)
+	} else {
+		report.table(w)
+	}
+	if filename != "-" {
+		fmt.Printf("Created report %q\n", filename)
+	}
+}
+
+// Write the report as a table, one line for each threshold
+func (report ReportT) table(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "threshold\tcontours\tholes\tdropped\tarea mm²\tarea px\tlength mm\tmin mm\tmax mm\tmean mm\tpoints\tcompressed\tplotted\t")
+	row := func(name string, lr LevelReportT) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f\t%.1f\t%.1f\t%.2f\t%.2f\t%.2f\t%d\t%d\t%d\t\n", name, lr.Contours, lr.Holes, lr.Dropped,
+			lr.Area, lr.AreaPixels, lr.Length, lr.MinLength, lr.MaxLength, lr.MeanLength, lr.Points, lr.CompressedPoints, lr.PlottedPoints)
+	}
+	for _, lr := range report.Levels {
+		row(fmt.Sprintf("%g", lr.Threshold), lr)
+	}
+	row("total", report.Total)
+	tw.Flush()
+}
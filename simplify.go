@@ -0,0 +1,262 @@
+// simplify.go -- leaving out points that make little difference to a path
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/heap"
+	"math"
+	"slices"
+)
+
+// Compress() only leaves out points that are in line with their neighbours,
+// so contours traced from noisy photos keep every wiggle, however small.
+// Simplifying leaves out points that make less difference than a tolerance,
+// given in mm on the paper.  As with smoothing, the ends of open paths and
+// points on the frame are kept, and closed paths stay closed.
+
+// Simplification methods, as given by --simplify-method
+var simplifyMethods = []string{"rdp", "visvalingam"}
+
+// Simplify the layer's paths, and its fills, as given by --simplify and --simplify-method.
+func (layer *LayerT) simplifyPaths(opts OptsT) {
+	box := smoothFrame(opts)
+	tolerance := opts.simplify / newPlacement(opts).scale // in pixels
+	for _, paths := range []ContourS{layer.paths, layer.fills} {
+		for i, path := range paths {
+			if opts.simplifyMethod == "visvalingam" {
+				paths[i] = visvalingam(path, tolerance*tolerance, box)
+			} else {
+				paths[i] = douglasPeucker(path, tolerance, box)
+			}
+		}
+	}
+}
+
+// The number of points in some paths
+func countPoints(paths ContourS) int {
+	n := 0
+	for _, path := range paths {
+		n += len(path)
+	}
+	return n
+}
+
+// Distance from p to the line from a to b (or to a, if b is the same point)
+func lineDistance(p, a, b Point64T) float64 {
+	length := a.Distance(b)
+	if length == 0 {
+		return p.Distance(a)
+	}
+	return math.Abs((b.x-a.x)*(a.y-p.y)-(a.x-p.x)*(b.y-a.y)) / length
+}
+
+// Area of the triangle abc
+func triangleArea(a, b, c Point64T) float64 {
+	return math.Abs((b.x-a.x)*(c.y-a.y)-(c.x-a.x)*(b.y-a.y)) / 2
+}
+
+// Ramer-Douglas-Peucker: between two points that are kept, keep the point
+// that's furthest from the line between them, if it's further than the
+// tolerance, and so on until every point left out is within the tolerance.
+// Pinned points are always kept.  A closed path with fewer than two pinned
+// points is split at its first point (or the pinned one) and the point
+// furthest from it, and it keeps at least three points.
+func douglasPeucker(path ContourT, tolerance float64, box [4]float64) ContourT {
+	if len(path) < 3 {
+		return path
+	}
+	pinned := pinnedPoints(path, box)
+	closed := path.IsClosed()
+	n := len(path)
+	keep := make([]bool, n)
+	var anchors []int
+	for i := range path {
+		if pinned[i] {
+			anchors = append(anchors, i)
+		}
+	}
+	if closed {
+		// start at a pinned point, if there is one, and make sure there's another
+		n-- // the last point is the same as the first
+		start := 0
+		if len(anchors) > 0 {
+			start = anchors[0]
+		}
+		path = rotatePath(path, start)
+		pinned = slices.Concat(pinned[start:n], pinned[:start+1])
+		anchors = anchors[:0]
+		for i, pin := range pinned {
+			if pin || i == 0 || i == n {
+				anchors = append(anchors, i)
+			}
+		}
+		if len(anchors) == 2 {
+			anchors = []int{0, furthestPoint(path, 0, n, path[0]), n}
+		}
+	}
+	// The point between i and j that's furthest from the line between them
+	var simplify func(i, j int)
+	simplify = func(i, j int) {
+		best, bestDist := -1, tolerance
+		for k := i + 1; k < j; k++ {
+			if d := lineDistance(path[k], path[i], path[j]); d > bestDist {
+				best, bestDist = k, d
+			}
+		}
+		if best >= 0 {
+			keep[best] = true
+			simplify(i, best)
+			simplify(best, j)
+		}
+	}
+	for a, i := range anchors {
+		keep[i] = true
+		if a+1 < len(anchors) {
+			simplify(i, anchors[a+1])
+		}
+	}
+	simplified := make(ContourT, 0, len(path))
+	for i, p := range path {
+		if keep[i] {
+			simplified = append(simplified, p)
+		}
+	}
+	if closed && len(simplified) < 4 {
+		// a triangle at least
+		keep[furthestFromLine(path, simplified[0], simplified[1])] = true
+		simplified = simplified[:0]
+		for i, p := range path {
+			if keep[i] {
+				simplified = append(simplified, p)
+			}
+		}
+	}
+	return simplified
+}
+
+// The point between path[i] and path[j] (not including them) that's furthest from p
+func furthestPoint(path ContourT, i, j int, p Point64T) int {
+	best, bestDist := i+1, -1.0
+	for k := i + 1; k < j; k++ {
+		if d := p.Distance(path[k]); d > bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// The point of a path that's furthest from the line from a to b
+func furthestFromLine(path ContourT, a, b Point64T) int {
+	best, bestDist := 0, -1.0
+	for k, p := range path {
+		if d := lineDistance(p, a, b); d > bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// Visvalingam-Whyatt: over and over, leave out the point that makes the
+// smallest triangle with its neighbours, until there isn't one smaller than
+// minArea.  Pinned points are always kept, and closed paths keep at least
+// three points.
+func visvalingam(path ContourT, minArea float64, box [4]float64) ContourT {
+	if len(path) < 3 {
+		return path
+	}
+	pinned := pinnedPoints(path, box)
+	closed := path.IsClosed()
+	n := len(path)
+	if closed {
+		n-- // the last point is the same as the first
+	}
+	// the points that are left, as a linked list
+	prev := make([]int, n)
+	next := make([]int, n)
+	for i := 0; i < n; i++ {
+		prev[i] = i - 1
+		next[i] = i + 1
+	}
+	if closed {
+		prev[0] = n - 1
+		next[n-1] = 0
+	}
+	removed := make([]bool, n)
+	queue := &triangleQueue{}
+	// version[i] goes up when point i's triangle changes, so older entries in the queue can be ignored
+	version := make([]int, n)
+	push := func(i int) {
+		if pinned[i] || prev[i] < 0 || next[i] >= n {
+			return
+		}
+		version[i]++
+		heap.Push(queue, triangleT{i, version[i], triangleArea(path[prev[i]], path[i], path[next[i]])})
+	}
+	for i := 0; i < n; i++ {
+		push(i)
+	}
+	left := n
+	for queue.Len() > 0 && (!closed || left > 3) {
+		t := heap.Pop(queue).(triangleT)
+		if removed[t.index] || t.version != version[t.index] {
+			continue
+		}
+		if t.area >= minArea {
+			break
+		}
+		i := t.index
+		removed[i] = true
+		left--
+		next[prev[i]] = next[i]
+		prev[next[i]] = prev[i]
+		push(prev[i])
+		push(next[i])
+	}
+	simplified := make(ContourT, 0, left+1)
+	for i, p := range path[:n] {
+		if !removed[i] {
+			simplified = append(simplified, p)
+		}
+	}
+	if closed {
+		simplified = append(simplified, simplified[0])
+	}
+	return simplified
+}
+
+// A point, and the area of the triangle it makes with its neighbours
+type triangleT struct {
+	index   int
+	version int
+	area    float64
+}
+
+// Triangles, smallest first, for container/heap
+type triangleQueue []triangleT
+
+func (q triangleQueue) Len() int           { return len(q) }
+func (q triangleQueue) Less(i, j int) bool { return q[i].area < q[j].area }
+func (q triangleQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *triangleQueue) Push(x any)        { *q = append(*q, x.(triangleT)) }
+func (q *triangleQueue) Pop() any {
+	old := *q
+	t := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return t
+}
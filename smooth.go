@@ -0,0 +1,198 @@
+// smooth.go -- smoothing paths, so that they don't follow the pixel grid
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"slices"
+)
+
+// Contours are traced between the centres of pixels, so they're made of
+// short straight lines at a few angles, which looks faceted when a small
+// image is scaled up.  Smoothing cuts the corners off (Chaikin), or draws
+// curves through the points (Catmull-Rom, as cubic Beziers).
+// Either way, the ends of open paths, and points on the frame, stay put,
+// so that paths still meet the edge where they did.
+
+// Smoothing methods, as given by --smooth
+var smoothModes = []string{"none", "chaikin", "curve"}
+
+// Formats that can draw curves themselves, with --smooth curve.
+// For the others, the curves are made into short lines before they're plotted.
+var curveFormats = []string{"", "svg"}
+
+// How many times corners are cut with --smooth chaikin
+const chaikinPasses = 2
+
+// How many lines each curve is made into, for formats that can't draw curves
+const curveSteps = 8
+
+// A cubic Bezier curve to p from the point before it, with control points c1 and c2
+type BezierT struct {
+	c1, c2, p Point64T
+}
+
+// The rectangle that paths are pinned to when they're smoothed: the
+// clipping rectangle with --clip, otherwise the edge of the image.
+func smoothFrame(opts OptsT) [4]float64 {
+	if opts.clip {
+		return clipBox(opts, newPlacement(opts).scale)
+	}
+	return imageBox(opts.width, opts.height)
+}
+
+// Smooth the layer's paths, and its fills, as given by --smooth.  Curves are
+// left to the plotter, if it can draw them.
+func (layer *LayerT) smoothPaths(opts OptsT) {
+	box := smoothFrame(opts)
+	for _, paths := range []ContourS{layer.paths, layer.fills} {
+		for i, path := range paths {
+			switch opts.smooth {
+			case "chaikin":
+				for pass := 0; pass < chaikinPasses; pass++ {
+					path = chaikin(path, box)
+				}
+			case "curve":
+				if !slices.Contains(curveFormats, opts.format) {
+					path = flattenCurve(path, box)
+				}
+			}
+			paths[i] = path
+		}
+	}
+}
+
+// The point t of the way from a to b
+func lerp(a, b Point64T, t float64) Point64T {
+	return Point64T{a.x + (b.x-a.x)*t, a.y + (b.y-a.y)*t}
+}
+
+func onBoxEdge(p Point64T, box [4]float64) bool {
+	return math.Abs(p.x-box[0]) < edgeTolerance || math.Abs(p.y-box[1]) < edgeTolerance ||
+		math.Abs(p.x-box[2]) < edgeTolerance || math.Abs(p.y-box[3]) < edgeTolerance
+}
+
+// Which points of a path have to stay where they are: the ends of an open
+// path, and any that are on the edge of the box.
+func pinnedPoints(path ContourT, box [4]float64) []bool {
+	pinned := make([]bool, len(path))
+	for i, p := range path {
+		pinned[i] = onBoxEdge(p, box)
+	}
+	if !path.IsClosed() {
+		pinned[0] = true
+		pinned[len(path)-1] = true
+	}
+	return pinned
+}
+
+// Chaikin's corner cutting: each point is replaced by two, a quarter of the
+// way along the lines to its neighbours.  Done over and over, it converges on
+// a quadratic B-spline.  Pinned points are kept as they are.
+func chaikin(path ContourT, box [4]float64) ContourT {
+	if len(path) < 3 {
+		return path
+	}
+	pinned := pinnedPoints(path, box)
+	closed := path.IsClosed()
+	n := len(path)
+	if closed {
+		n-- // the last point is the same as the first
+	}
+	smoothed := make(ContourT, 0, 2*len(path))
+	for i, p := range path[:n] {
+		if pinned[i] {
+			smoothed = append(smoothed, p)
+			continue
+		}
+		// (the ends of open paths are pinned, so this only wraps round closed ones)
+		prev := path[(i+n-1)%n]
+		next := path[(i+1)%n]
+		smoothed = append(smoothed, lerp(p, prev, 0.25), lerp(p, next, 0.25))
+	}
+	if closed {
+		smoothed = append(smoothed, smoothed[0])
+	}
+	return smoothed
+}
+
+// A Catmull-Rom spline through the points of a path, as Bezier curves from
+// each point to the next.  The curve through each point is parallel to the
+// line between its neighbours, except at pinned points, where the curves
+// on each side head straight for the next point.  So lines along the edge
+// of the box stay straight, and on it.
+func catmullRom(path ContourT, box [4]float64) []BezierT {
+	if len(path) < 2 {
+		return nil
+	}
+	pinned := pinnedPoints(path, box)
+	n := len(path)
+	if path.IsClosed() {
+		n-- // the last point is the same as the first
+	}
+	// A sixth of the line between the neighbours of the ith point
+	tangent := func(i int) Point64T {
+		prev := path[(i+n-1)%n]
+		next := path[(i+1)%n]
+		return Point64T{(next.x - prev.x) / 6, (next.y - prev.y) / 6}
+	}
+	curves := make([]BezierT, 0, len(path)-1)
+	for i := 0; i < len(path)-1; i++ {
+		a, b := path[i], path[i+1]
+		c1 := lerp(a, b, 1.0/6)
+		if !pinned[i] {
+			t := tangent(i)
+			c1 = Point64T{a.x + t.x, a.y + t.y}
+		}
+		c2 := lerp(b, a, 1.0/6)
+		if !pinned[i+1] {
+			t := tangent(i + 1)
+			c2 = Point64T{b.x - t.x, b.y - t.y}
+		}
+		curves = append(curves, BezierT{c1, c2, b})
+	}
+	return curves
+}
+
+// The point t of the way along a Bezier curve from a
+func (b BezierT) at(a Point64T, t float64) Point64T {
+	mt := 1 - t
+	k0, k1, k2, k3 := mt*mt*mt, 3*mt*mt*t, 3*mt*t*t, t*t*t
+	return Point64T{k0*a.x + k1*b.c1.x + k2*b.c2.x + k3*b.p.x, k0*a.y + k1*b.c1.y + k2*b.c2.y + k3*b.p.y}
+}
+
+// The Catmull-Rom spline through a path, made into short lines, for formats
+// that can't draw curves.  Each curve ends exactly on the next point, so
+// closed paths stay closed.
+func flattenCurve(path ContourT, box [4]float64) ContourT {
+	if len(path) < 3 {
+		return path
+	}
+	flat := make(ContourT, 0, (len(path)-1)*curveSteps+1)
+	flat = append(flat, path[0])
+	a := path[0]
+	for _, curve := range catmullRom(path, box) {
+		for k := 1; k < curveSteps; k++ {
+			flat = append(flat, curve.at(a, float64(k)/curveSteps))
+		}
+		flat = append(flat, curve.p)
+		a = curve.p
+	}
+	return flat
+}
@@ -0,0 +1,187 @@
+// styles.go -- stroke styles for the contour layers
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Stroke style for one layer.  Zero values mean 'the same as the rest'.
+type StrokeStyleT struct {
+	colour  string    // six hex digits, e.g. "ff0000"
+	width   float64   // in mm
+	dash    []float64 // lengths of dashes and gaps, in mm
+	opacity float64   // 0..1
+	index   bool      // the layer holds index contours
+}
+
+var validColour = regexp.MustCompile(`(?i:^[0-9a-f]{6}$)`)
+
+// Parse one layer's style, e.g. "colour=ff0000,width=0.3,dash=2/1,opacity=0.8".
+// A bare colour is short for colour=..., and an empty style or "-" leaves
+// everything as it is.
+func parseStrokeStyle(spec string) (StrokeStyleT, error) {
+	var style StrokeStyleT
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "-" {
+		return style, nil
+	}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, hasValue := strings.Cut(strings.TrimSpace(field), "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if !hasValue {
+			key, value = "colour", key
+		}
+		var err error
+		switch key {
+		case "colour", "color":
+			if !validColour.MatchString(value) {
+				return style, fmt.Errorf("invalid colour '%s' in style '%s'", value, spec)
+			}
+			style.colour = strings.ToLower(value)
+		case "width":
+			style.width, err = strconv.ParseFloat(value, 64)
+			if err != nil || style.width <= 0 {
+				return style, fmt.Errorf("invalid width '%s' in style '%s'", value, spec)
+			}
+		case "dash":
+			for _, d := range strings.FieldsFunc(value, func(r rune) bool { return r == '/' || r == ' ' }) {
+				length, err := strconv.ParseFloat(d, 64)
+				if err != nil || length < 0 {
+					return style, fmt.Errorf("invalid dash '%s' in style '%s'", value, spec)
+				}
+				style.dash = append(style.dash, length)
+			}
+			if len(style.dash) == 0 {
+				return style, fmt.Errorf("invalid dash '%s' in style '%s'", value, spec)
+			}
+		case "opacity":
+			style.opacity, err = strconv.ParseFloat(value, 64)
+			if err != nil || style.opacity <= 0 || style.opacity > 1 {
+				return style, fmt.Errorf("invalid opacity '%s' in style '%s'", value, spec)
+			}
+		default:
+			return style, fmt.Errorf("unknown setting '%s' in style '%s'", key, spec)
+		}
+	}
+	return style, nil
+}
+
+// Parse the styles for the layers, separated by semicolons, e.g.
+// "ff0000,width=0.3;0000ff,dash=2/1".
+func parseStrokeStyles(spec string) ([]StrokeStyleT, error) {
+	var styles []StrokeStyleT
+	for _, s := range strings.Split(spec, ";") {
+		style, err := parseStrokeStyle(s)
+		if err != nil {
+			return nil, err
+		}
+		styles = append(styles, style)
+	}
+	return styles, nil
+}
+
+// Read the styles for the layers from a file, one per line.
+// Blank lines and those starting with '#' are skipped.
+func loadStrokeStyles(path string) ([]StrokeStyleT, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read styles file: %s, %s", path, err)
+	}
+	defer fh.Close()
+	var styles []StrokeStyleT
+	scanner := bufio.NewScanner(fh)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		style, err := parseStrokeStyle(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", path, lineNo, err)
+		}
+		styles = append(styles, style)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read styles file: %s, %s", path, err)
+	}
+	if len(styles) == 0 {
+		return nil, fmt.Errorf("no styles in file: %s", path)
+	}
+	return styles, nil
+}
+
+// Settings in s that are set replace those in style.
+func (style StrokeStyleT) overlay(s StrokeStyleT) StrokeStyleT {
+	if s.colour != "" {
+		style.colour = s.colour
+	}
+	if s.width > 0 {
+		style.width = s.width
+	}
+	if len(s.dash) > 0 {
+		style.dash = s.dash
+	}
+	if s.opacity > 0 {
+		style.opacity = s.opacity
+	}
+	return style
+}
+
+// Is the i'th threshold (counting from 0) an index level?
+// With --interval, index levels are every Nth multiple of the interval
+// from the base, as on a map; otherwise it's every Nth threshold.
+func isIndexLevel(opts OptsT, i int) bool {
+	if opts.indexEvery < 1 {
+		return false
+	}
+	if opts.interval > 0 {
+		k := int(math.Round((opts.thresholds[i] - opts.base) / opts.interval))
+		return k%opts.indexEvery == 0
+	}
+	return (i+1)%opts.indexEvery == 0
+}
+
+// Work out the stroke style for each layer: [0] is the background,
+// and [i+1] is for opts.thresholds[i].  The styles from --styles are
+// used in turn, starting again at the first if there are more layers
+// than styles, and take precedence over those for index contours.
+func layerStyles(opts OptsT) []StrokeStyleT {
+	styles := make([]StrokeStyleT, len(opts.thresholds)+1)
+	for i := range opts.thresholds {
+		if isIndexLevel(opts, i) {
+			width := opts.indexLinewidth
+			if width == 0 {
+				width = opts.linewidth * 2
+			}
+			styles[i+1] = StrokeStyleT{colour: opts.indexColour, width: width, index: true}
+		}
+		if len(opts.strokeStyles) > 0 {
+			styles[i+1] = styles[i+1].overlay(opts.strokeStyles[i%len(opts.strokeStyles)])
+		}
+	}
+	return styles
+}
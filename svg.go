@@ -20,7 +20,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"math"
 	"os"
 	"path"
@@ -35,8 +34,14 @@ type SVGfile struct {
 	pathCounter     int
 	polygonCounter  int
 	polylineCounter int
-	thresholds      []int    // [0] is the background, so other indexes are bumped up by 1
-	colours         []string //			SVGColourM // indexed by threshold
+	thresholds      []float64      // [0] is the background, so other indexes are bumped up by 1
+	colours         []string       //			SVGColourM // indexed by threshold
+	styles          []StrokeStyleT // indexed like thresholds
+	scale           float64
+	clip            bool
+	clipGeometry    bool       // no clip path: the contours are clipped already, and AxiDraw ignores it
+	curves          bool       // draw curves through the points, with --smooth curve
+	frame           [4]float64 // where curves are pinned, as smoothFrame()
 }
 
 func (svg *SVGfile) write(s string) {
@@ -68,57 +73,6 @@ func (svg *SVGfile) polygon(contour ContourT, args string) {
 	svg.write(fmt.Sprint("\" />\n"))
 }
 
-// Find the intercept between the line through p1 and p2 and the vertical line at x
-func interceptX(p1, p2 Point64T, x float64) Point64T {
-	m := (p2.y - p1.y) / (p2.x - p1.x)
-	c := p1.y - m*p1.x
-	y := m*x + c
-	//fmt.Printf("iX: p1=%v p2=%v x=%v m=%v c=%v y=%v\n", p1, p2, x, m, c, y)
-	return Point64T{x, y}
-}
-
-// Find the intercept between the line through p1 and p2 and the horizontal line at y
-func interceptY(p1, p2 Point64T, y float64) Point64T {
-	m := (p2.y - p1.y) / (p2.x - p1.x)
-	c := p1.y - m*p1.x
-	x := (y - c) / m
-	return Point64T{x, y}
-}
-
-// Find the point on the edge of the image where the line
-// from p1 to p2 crosses the edge.
-// Assumes p1 is without the image, p2 is within it.
-// NOTE to match with offImage() below, the edge is actually
-// 1 pixel in.
-func edgePoint(outPoint, inPoint Point64T, width, height int) Point64T {
-	if outPoint.x < 0 {
-		outPoint = interceptX(inPoint, outPoint, 0)
-	}
-	if outPoint.x > float64(width) {
-		outPoint = interceptX(inPoint, outPoint, float64(width))
-	}
-	if outPoint.y < 0 {
-		outPoint = interceptY(inPoint, outPoint, 0)
-	}
-	if outPoint.y > float64(height) {
-		outPoint = interceptY(inPoint, outPoint, float64(height))
-	}
-	return outPoint
-}
-
-// 'off the image' includes contours around shapes that hit the edge.
-// Because values have already been increased by 0.5 (in PointWeightedAvg()),
-// choose anything here that's within 1 pixel of the edge.
-// FIXME move this -- it's not an SVG thing
-// FIXME limit is now 0.0
-func offImage(p Point64T, width, height int) bool {
-	const limit = 0.0 //1.0
-	if p.x < limit || p.y < limit || p.x > float64(width)-limit || p.y > float64(height)-limit {
-		return true
-	}
-	return false
-}
-
 // Given a contour (a slice of coordinates), make them into a polyline
 func (svg *SVGfile) polyline(contour ContourT) {
 	//fmt.Printf("polyline: %v\n", contour)
@@ -132,66 +86,40 @@ func (svg *SVGfile) polyline(contour ContourT) {
 
 // Polygon, or polyline if not closed
 func (svg *SVGfile) polyshape(contour ContourT) {
-	ccontour := contour.Compress()
-	if ccontour[0].Equal(ccontour[len(ccontour)-1]) {
-		svg.polygon(ccontour, "")
+	if contour[0].Equal(contour[len(contour)-1]) {
+		svg.polygon(contour, "")
 	} else {
-		svg.polyline(ccontour)
+		svg.polyline(contour)
 	}
 }
 
-// Plot a contour onto the SVG file: as a polygon unless it goes off the
-// edge of the image, in which case it becomes one or more polylines.
-func (svg *SVGfile) plotContour(contour ContourT, width, height int) {
-	lineOpen := false
-	//fmt.Printf("plotC: contour=%v\n", contour)
-	var subContour ContourT // may not be the whole contour
-	for i, p := range contour {
-		if offImage(p, width, height) {
-			//fmt.Printf("plotC: offImage at %v  lineOpen=%v\n", p, lineOpen)
-			if lineOpen {
-				// stop the line - end right at the edge(s)
-				edgeP := edgePoint(p, contour[i-1], width, height)
-				subContour = append(subContour, edgeP)
-				//fmt.Printf("plotC: stopping c-1=%v  p=%v  w=%v  h=%v  edgeP=%v subC=%v\n", contour[i-1], p, width, height, edgeP, subContour)
-				svg.polyshape(subContour)
-				subContour = nil
-				lineOpen = false
-			} else {
-				//fmt.Printf("plotC: skipping %v\n", p)
-				// line already closed -- skip the point
-				// But wait!  what if we've gone over a corner?  FIXME TODO
-				// Edge case (literally) -- line that starts and ends off-image -- see test11.png
-			}
-		} else {
-			//fmt.Printf("plotC: on Image at %v  lineOpen=%v\n", p, lineOpen)
-			if !lineOpen {
-				// start a new line
-				subContour = make(ContourT, 0, 10)
-				if i > 0 {
-					// Not the first point -- we've come back from off-image, so start on the edge
-					edgeP := edgePoint(contour[i-1], p, width, height)
-					//fmt.Printf("plotC: starting at edgeP %v\n", edgeP)
-					subContour = append(subContour, edgeP)
-				} else {
-					//fmt.Printf("plotC: starting on image\n")
-				}
-				lineOpen = true
-			}
-			//fmt.Printf("plotC: adding %v\n", p)
-			subContour = append(subContour, p)
-		}
+// Given a contour, draw a curve through its points as a path; the
+// replacement for polygon() and polyline() with --smooth curve.
+func (svg *SVGfile) curve(contour ContourT) {
+	svg.write(fmt.Sprintf("<path id=\"%d\" d=\"", svg.pathCounter))
+	svg.pathCounter += 1
+	svg.curveData(contour)
+	if contour.IsClosed() {
+		svg.write("Z ")
 	}
-	if lineOpen {
-		// stop the line
-		//fmt.Printf("plotC: final close\n")
-		svg.polyshape(subContour)
-		subContour = nil
+	svg.write(fmt.Sprint("\" />\n"))
+}
+
+// Write the curve through a contour's points, as cubic Beziers.
+// e.g. M 10,20 C 12,20 18,18 20,20 C ...
+func (svg *SVGfile) curveData(contour ContourT) {
+	svg.write(fmt.Sprintf("M %.2f,%.2f ", contour[0].x, contour[0].y))
+	for _, b := range catmullRom(contour, svg.frame) {
+		svg.write(fmt.Sprintf("C %.2f,%.2f %.2f,%.2f %.2f,%.2f ", b.c1.x, b.c1.y, b.c2.x, b.c2.y, b.p.x, b.p.y))
 	}
 }
 
 func (svg *SVGfile) closedPathStart(args string) {
-	svg.write(fmt.Sprintf("<path id=\"%d\" clip-path=\"url(#clip1)\" %s d=\"", svg.pathCounter, args))
+	clipPath := " clip-path=\"url(#clip1)\""
+	if svg.clipGeometry {
+		clipPath = ""
+	}
+	svg.write(fmt.Sprintf("<path id=\"%d\"%s %s d=\"", svg.pathCounter, clipPath, args))
 	svg.pathCounter += 1
 }
 
@@ -201,21 +129,61 @@ func (svg *SVGfile) closedPathStop() {
 
 // Write one contour's worth of points to an already started path.
 // e.g. M 10,20 L 20,20, L 20,10 Z
+// (A piece of a contour that's been broken isn't closed, so it has no Z.)
 func (svg *SVGfile) closedPathLoop(contour ContourT, args string) {
-	cmd := "M"
-	for _, p := range contour {
-		svg.write(fmt.Sprintf("%s %.2f,%.2f ", cmd, p.x, p.y))
-		cmd = "L"
+	if svg.curves {
+		svg.curveData(contour)
+	} else {
+		cmd := "M"
+		for _, p := range contour {
+			svg.write(fmt.Sprintf("%s %.2f,%.2f ", cmd, p.x, p.y))
+			cmd = "L"
+		}
+	}
+	if contour.IsClosed() {
+		svg.write("Z ")
 	}
-	svg.write("Z ")
 }
 
-// Alternative strategy to plot a contour, using clipping instead of broken paths.
-// This will allow filling, but won't work with AxiDraw.
-func (svg *SVGfile) plotContourClip(contour ContourT, width, height int) {
-	const args = "clip-path=\"url(#clip1)\""
-	ccontour := contour.Compress()
-	svg.closedPathLoop(ccontour, args)
+// Plot a layer's paths.  When clipping, they're closed loops, clipped
+// already, and go in a single path, which allows filling; the clip path
+// that goes with it (which AxiDraw ignores) can be left out with
+// --clip-geometry.  If places with no data have broken some of them, the
+// loops are filled in one path, and what's left of them is stroked in
+// another.  Otherwise they're polygons or polylines.
+func (svg *SVGfile) plotLayer(layer *LayerT) {
+	svg.layer(layer.index, layer.label, layer.index-1)
+	if svg.clip && layer.broken() {
+		if len(svg.colours) > 0 && len(layer.fills) > 0 {
+			svg.closedPathStart("stroke=\"none\"")
+			for _, path := range layer.fills {
+				svg.closedPathLoop(path, "")
+			}
+			svg.closedPathStop()
+		}
+		if len(layer.paths) > 0 {
+			svg.closedPathStart("fill=\"none\"")
+			for _, path := range layer.paths {
+				svg.closedPathLoop(path, "")
+			}
+			svg.closedPathStop()
+		}
+	} else if svg.clip {
+		svg.closedPathStart("")
+		for _, path := range layer.paths {
+			svg.closedPathLoop(path, "")
+		}
+		svg.closedPathStop()
+	} else {
+		for _, path := range layer.paths {
+			if svg.curves {
+				svg.curve(path)
+			} else {
+				svg.polyshape(path)
+			}
+		}
+	}
+	svg.endLayer()
 }
 
 func calcSizes(image RectangleT, margin float64, paper RectangleT, framewidth float64) (RectangleT, float64) {
@@ -245,34 +213,32 @@ func calcSizes(image RectangleT, margin float64, paper RectangleT, framewidth fl
 // Parse the colour string, e.g. "00ff00" or "123456,abcdef,ff7700" or "222222-eeeeee"
 // into a slice of such values.
 // The input has already been validated by regexp, so no error checking done here.
-// Assumes svg.thresholds has already be set up.
-func (svg *SVGfile) setColours(colourString string) {
+// layers is the number of thresholds, plus 1 for the background.
+func parseColours(colourString string, layers int) []string {
 	if colourString == "" {
-		return
+		return nil
 	}
 
 	colourString = strings.ToLower(colourString)
 	if len(colourString) == 6 {
 		// Single colour -- treat as two (one for contour, one for background)
-		svg.colours = []string{colourString, colourString}
-		return
+		return []string{colourString, colourString}
 	}
 
 	if colourString[6:7] == "," {
 		// List of colours
-		svg.colours = strings.Split(colourString, ",")
-		return
+		return strings.Split(colourString, ",")
 	}
 
 	// Range of colours  123456-abcdef
-	svg.colours = make([]string, len(svg.thresholds))
+	colours := make([]string, layers)
 	hex0 := colourString[:6]
 	hex1 := colourString[7:]
 
 	// first contour gets first colour
-	svg.colours[0] = hex0
+	colours[0] = hex0
 
-	tcount := len(svg.thresholds) // including 1 for the background
+	tcount := layers // including 1 for the background
 	if tcount > 2 {
 		r0, _ := strconv.ParseInt(colourString[0:2], 16, 0)
 		g0, _ := strconv.ParseInt(colourString[2:4], 16, 0)
@@ -283,34 +249,41 @@ func (svg *SVGfile) setColours(colourString string) {
 		rStep := float64(r1-r0) / float64(tcount-1)
 		gStep := float64(g1-g0) / float64(tcount-1)
 		bStep := float64(b1-b0) / float64(tcount-1)
-		//fmt.Printf("input=%s  t's=%v  %02x %02x %02x   %02x %02x %02x   step: %v %v %v\n", colourString, svg.thresholds, r0, g0, b0, r1, g1, b1, rStep, gStep, bStep)
+		//fmt.Printf("input=%s  layers=%v  %02x %02x %02x   %02x %02x %02x   step: %v %v %v\n", colourString, layers, r0, g0, b0, r1, g1, b1, rStep, gStep, bStep)
 		for i := 1; i < tcount; i++ {
 			r := r0 + int64(math.Round(float64(i)*rStep))
 			g := g0 + int64(math.Round(float64(i)*gStep))
 			b := b0 + int64(math.Round(float64(i)*bStep))
-			svg.colours[i] = fmt.Sprintf("%02x%02x%02x", r, g, b)
+			colours[i] = fmt.Sprintf("%02x%02x%02x", r, g, b)
 		}
 	}
 
 	// background counts as last threshold
-	svg.colours[len(svg.colours)-1] = hex1
-	//fmt.Printf("setColours: %#v\n", svg.colours)
+	colours[len(colours)-1] = hex1
+	//fmt.Printf("parseColours: %#v\n", colours)
+	return colours
+}
+
+// Assumes svg.thresholds has already be set up.
+func (svg *SVGfile) setColours(colourString string) {
+	svg.colours = parseColours(colourString, len(svg.thresholds))
 }
 
 func (svg *SVGfile) open(filename string) {
 	svg.filename = filename
-	fh, err := os.Create(svg.filename)
-	if err != nil {
-		log.Fatalf("Unable to open SVG file %q - %s", svg.filename, err)
-	}
-	svg.file = fh
+	svg.file = createFile(filename)
 	svg.write("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n") // needed so that next line can be a comment
 }
 
 func (svg *SVGfile) start(opts OptsT) (scale float64) {
-	svg.currentLayer = -1                                 // no layer open
-	svg.thresholds = append([]int{0}, opts.thresholds...) // the background counts as threshold 0
+	svg.currentLayer = -1                                     // no layer open
+	svg.thresholds = append([]float64{0}, opts.thresholds...) // the background counts as threshold 0
 	svg.setColours(opts.colours)
+	svg.styles = layerStyles(opts)
+	svg.clip = opts.clip
+	svg.clipGeometry = opts.clipGeometry
+	svg.curves = opts.smooth == "curve"
+	svg.frame = smoothFrame(opts)
 	// write the wrapper SVG with  background colour first
 	viewbox := fmt.Sprintf("viewBox=\"0 0 %g %g\"", opts.paperSize.width, opts.paperSize.height)
 	// Set background via style rather than filling an oversized rect (which upsets Axidraw)
@@ -328,6 +301,7 @@ func (svg *SVGfile) start(opts OptsT) (scale float64) {
 	}
 
 	translate, scale := calcSizes(RectangleT{float64(opts.width), float64(opts.height)}, opts.margin, opts.paperSize, opts.framewidth)
+	svg.scale = scale
 
 	// Debug only: show plot limits
 	if opts.debug {
@@ -349,10 +323,10 @@ func (svg *SVGfile) start(opts OptsT) (scale float64) {
 	// It's only an issue with very wide contour lines.
 	clippage := 0.0
 	if opts.clip {
-		clippage = opts.linewidth / 2 / scale
+		clippage = clipBox(opts, scale)[0]
 	}
 
-	if opts.clip { // inside the transformed group
+	if opts.clip && !opts.clipGeometry { // inside the transformed group
 		clipString := fmt.Sprintf("<defs><clipPath id=\"clip1\" ><rect id=\"cliprect\" width=\"%.4f\" height=\"%.4f\" x=\"%.4f\" y=\"%.4f\" /></clipPath></defs>\n", float64(opts.width)-clippage*2, float64(opts.height)-clippage*2, clippage, clippage)
 		svg.write(clipString)
 	}
@@ -362,7 +336,11 @@ func (svg *SVGfile) start(opts OptsT) (scale float64) {
 
 	if opts.image {
 		// CHECK clip image same as plot?
-		imageString := fmt.Sprintf("<image id=\"background\" href=\"%s\" width=\"%d\" height=\"%d\" clip-path=\"url(#clip1)\" />\n", path.Base(opts.infile), opts.width, opts.height)
+		clipPath := " clip-path=\"url(#clip1)\""
+		if opts.clipGeometry {
+			clipPath = ""
+		}
+		imageString := fmt.Sprintf("<image id=\"background\" href=\"%s\" width=\"%d\" height=\"%d\"%s />\n", path.Base(opts.infile), opts.width, opts.height, clipPath)
 		//fmt.Print(imageString)
 		svg.write(imageString)
 	}
@@ -371,6 +349,10 @@ func (svg *SVGfile) start(opts OptsT) (scale float64) {
 	if len(svg.colours) > 0 {
 		rect := fmt.Sprintf("<rect id=\"plotsize\" width=\"%g\" height=\"%g\" stroke=\"none\" />\n",
 			float64(opts.width), float64(opts.height))
+		if clipBackground(opts) {
+			rect = fmt.Sprintf("<rect id=\"plotsize\" width=\"%.4f\" height=\"%.4f\" x=\"%.4f\" y=\"%.4f\" stroke=\"none\" />\n",
+				float64(opts.width)-clippage*2, float64(opts.height)-clippage*2, clippage, clippage)
+		}
 		svg.write(rect)
 	}
 
@@ -407,12 +389,33 @@ func (svg *SVGfile) stopSave() {
 }
 
 func (svg *SVGfile) startLayer(l int, label string, colourIdx int) {
-	fill := ""
+	attrs := make([]string, 0, 4)
 	if len(svg.colours) > 0 {
 		//fmt.Printf("svg.sL: contour fill: l=%d  svg.colours[%d]=%v\n", l, colourIdx, svg.colours[colourIdx%len(svg.colours)])
-		fill = fmt.Sprintf("fill=\"#%s\"", svg.colours[colourIdx%len(svg.colours)])
+		attrs = append(attrs, fmt.Sprintf("fill=\"#%s\"", svg.colours[colourIdx%len(svg.colours)]))
+	}
+	stroke := "black"
+	if l < len(svg.styles) {
+		style := svg.styles[l]
+		if style.colour != "" {
+			stroke = "#" + style.colour
+		}
+		if style.width > 0 {
+			// 'descaled' like the main group's stroke-width
+			attrs = append(attrs, fmt.Sprintf("stroke-width=\"%.4f\"", style.width/svg.scale))
+		}
+		if len(style.dash) > 0 {
+			dashes := make([]string, len(style.dash))
+			for i, d := range style.dash {
+				dashes[i] = fmt.Sprintf("%.4f", d/svg.scale)
+			}
+			attrs = append(attrs, fmt.Sprintf("stroke-dasharray=\"%s\"", strings.Join(dashes, " ")))
+		}
+		if style.opacity > 0 {
+			attrs = append(attrs, fmt.Sprintf("stroke-opacity=\"%g\"", style.opacity))
+		}
 	}
-	svg.write(fmt.Sprintf("<g inkscape:groupmode=\"layer\" inkscape:label=\"%d %s\" stroke=\"black\" %s >\n", svg.thresholds[l], label, fill))
+	svg.write(fmt.Sprintf("<g inkscape:groupmode=\"layer\" inkscape:label=\"%g %s\" stroke=\"%s\" %s >\n", svg.thresholds[l], label, stroke, strings.Join(attrs, " ")))
 	svg.currentLayer = l
 }
 func (svg *SVGfile) endLayer() {
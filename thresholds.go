@@ -0,0 +1,294 @@
+// thresholds.go -- ways of choosing the threshold levels
+
+// This file is part of hcontours -- HarrisContours.
+// Copyright (C) 2024 Chris Dennis, chris@starsoftanalysis.co.uk
+//
+// hcontours is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Limit on the number of levels that --interval can generate
+const maxIntervalThresholds = 1000
+
+// Strategies for --auto-thresholds
+var autoThresholdMethods = []string{"otsu", "quantile", "kmeans"}
+
+// Number of bins in the histogram used by Otsu's method and k-means
+const histogramBins = 256
+
+// Return a slice of n values evenly spaced between low and high,
+// e.g. 64,128,192 for n=3 with 8-bit values.
+// Integral values are treated as buckets, so the range is one bigger.
+// Assumes n is within the range 1 to 255
+func evenThresholds(n int, low, high float64, integral bool) []float64 {
+	span := high - low
+	if integral {
+		span += 1
+	}
+	step := span / float64(n+1)
+	thresholds := make([]float64, n)
+	for i := range n {
+		thresholds[i] = low + step*float64(i+1)
+		if integral {
+			thresholds[i] = math.Round(thresholds[i])
+		}
+	}
+	return thresholds
+}
+
+// Return the values base + k*interval that lie within [low, high].
+func intervalThresholds(interval, base, low, high float64) []float64 {
+	thresholds := make([]float64, 0, 10)
+	for k := math.Ceil((low - base) / interval); base+k*interval <= high; k++ {
+		// tidy up floating-point fuzz, e.g. 0.30000000000000004
+		thresholds = append(thresholds, math.Round((base+k*interval)*1e9)/1e9)
+		if len(thresholds) > maxIntervalThresholds {
+			break
+		}
+	}
+	return thresholds
+}
+
+// Work out the thresholds to use, now that the height map's range is known.
+// Thresholds given explicitly with --threshold are used as they are.
+func chooseThresholds(opts OptsT, hm *HeightMapT) ([]float64, error) {
+	low, high := hm.low, hm.high
+	if opts.tminSet {
+		low = opts.tmin
+	}
+	if opts.tmaxSet {
+		high = opts.tmax
+	}
+	if opts.interval > 0 {
+		thresholds := intervalThresholds(opts.interval, opts.base, low, high)
+		if len(thresholds) > maxIntervalThresholds {
+			return nil, fmt.Errorf("interval %g gives too many thresholds between %g and %g", opts.interval, low, high)
+		}
+		if !opts.tminSet && len(thresholds) > 0 && thresholds[0] <= hm.low {
+			// nothing is below the lowest value, so there'd be no contours
+			thresholds = thresholds[1:]
+		}
+		if len(thresholds) == 0 {
+			return nil, fmt.Errorf("no thresholds with interval %g and base %g between %g and %g", opts.interval, opts.base, low, high)
+		}
+		return thresholds, nil
+	}
+	if opts.autoThresholds != "" {
+		return autoThresholds(opts.autoThresholds, opts.tcount, hm)
+	}
+	if opts.tcount != -1 {
+		return evenThresholds(opts.tcount, low, high, hm.integral), nil
+	}
+	return opts.thresholds, nil
+}
+
+// A histogram of the height map's values, in equal-sized bins from
+// hm.low to hm.high.  For 8-bit images, there's one bin per value.
+type histogramT struct {
+	counts   []float64
+	low      float64
+	binWidth float64
+}
+
+func newHistogram(hm *HeightMapT) histogramT {
+	span := hm.high - hm.low
+	if hm.integral {
+		span += 1
+	}
+	h := histogramT{counts: make([]float64, histogramBins), low: hm.low, binWidth: span / histogramBins}
+	if h.binWidth == 0 {
+		h.binWidth = 1
+	}
+	for _, v := range hm.values {
+		if !math.IsNaN(v) {
+			bin := limitInt(int((v-hm.low)/h.binWidth), 0, histogramBins-1)
+			h.counts[bin] += 1
+		}
+	}
+	return h
+}
+
+// The value at the lower edge of a bin
+func (h histogramT) edge(bin int) float64 {
+	return h.low + float64(bin)*h.binWidth
+}
+
+// The value in the middle of a bin
+func (h histogramT) centre(bin int) float64 {
+	return h.low + (float64(bin)+0.5)*h.binWidth
+}
+
+// Choose n thresholds from the distribution of the height map's values,
+// rounded to a sensible precision and without duplicates.
+func autoThresholds(method string, n int, hm *HeightMapT) ([]float64, error) {
+	low, high := hm.valueRange()
+	if low > high {
+		return nil, fmt.Errorf("no data to choose thresholds from by method '%s'", method)
+	}
+	if low == high {
+		// nothing to separate
+		return nil, fmt.Errorf("no thresholds found by method '%s': every value is %g", method, low)
+	}
+	var thresholds []float64
+	switch method {
+	case "otsu":
+		thresholds = otsuThresholds(newHistogram(hm), n)
+	case "quantile":
+		thresholds = quantileThresholds(hm, n)
+	case "kmeans":
+		thresholds = kmeansThresholds(newHistogram(hm), n)
+	default:
+		return nil, fmt.Errorf("unknown method for automatic thresholds '%s'", method)
+	}
+	unit := 1.0
+	if !hm.integral {
+		unit = math.Pow(10, math.Floor(math.Log10((hm.high-hm.low)/1000)))
+	}
+	for i, t := range thresholds {
+		thresholds[i] = math.Round(round(t, unit)*1e9) / 1e9
+	}
+	thresholds = slices.DeleteFunc(thresholds, func(t float64) bool {
+		return math.IsNaN(t) || math.IsInf(t, 0)
+	})
+	slices.Sort(thresholds)
+	thresholds = slices.Compact(thresholds)
+	if len(thresholds) == 0 {
+		return nil, fmt.Errorf("no thresholds found by method '%s'", method)
+	}
+	return thresholds, nil
+}
+
+// Multi-level Otsu: split the histogram into n+1 classes so as to maximise
+// the variance between classes, which is the same as maximising the sum
+// over classes of (sum of values)^2 / (number of values).
+// Done by dynamic programming over the bins.
+func otsuThresholds(h histogramT, n int) []float64 {
+	bins := len(h.counts)
+	classes := min(n+1, bins)
+	// Cumulative counts and sums, so that any run of bins can be scored quickly
+	cumCount := make([]float64, bins+1)
+	cumSum := make([]float64, bins+1)
+	for i, c := range h.counts {
+		cumCount[i+1] = cumCount[i] + c
+		cumSum[i+1] = cumSum[i] + c*h.centre(i)
+	}
+	score := func(from, to int) float64 { // bins from..to-1
+		w := cumCount[to] - cumCount[from]
+		if w == 0 {
+			return 0
+		}
+		s := cumSum[to] - cumSum[from]
+		return s * s / w
+	}
+	// best[j][k]: best score for the first k bins in j+1 classes;
+	// start[j][k]: where the last of those classes starts
+	best := make([][]float64, classes)
+	start := make([][]int, classes)
+	for j := range best {
+		best[j] = make([]float64, bins+1)
+		start[j] = make([]int, bins+1)
+	}
+	for k := 1; k <= bins; k++ {
+		best[0][k] = score(0, k)
+	}
+	for j := 1; j < classes; j++ {
+		for k := j + 1; k <= bins; k++ {
+			best[j][k] = math.Inf(-1)
+			for m := j; m < k; m++ {
+				if v := best[j-1][m] + score(m, k); v > best[j][k] {
+					best[j][k] = v
+					start[j][k] = m
+				}
+			}
+		}
+	}
+	// Work back to find where the classes start
+	thresholds := make([]float64, classes-1)
+	k := bins
+	for j := classes - 1; j > 0; j-- {
+		k = start[j][k]
+		thresholds[j-1] = h.edge(k)
+	}
+	return thresholds
+}
+
+// Thresholds that split the pixels into n+1 groups of (as near as possible) the same size.
+func quantileThresholds(hm *HeightMapT, n int) []float64 {
+	values := make([]float64, 0, len(hm.values))
+	for _, v := range hm.values {
+		if !math.IsNaN(v) {
+			values = append(values, v)
+		}
+	}
+	slices.Sort(values)
+	thresholds := make([]float64, n)
+	for i := range thresholds {
+		// the first pixel of the next group is the threshold: it's not below it
+		thresholds[i] = values[len(values)*(i+1)/(n+1)]
+	}
+	return thresholds
+}
+
+// Cluster the values into n+1 groups with k-means, and put the thresholds
+// half way between neighbouring cluster centres.
+func kmeansThresholds(h histogramT, n int) []float64 {
+	k := n + 1
+	// Start with the centres spread evenly through the histogram
+	centres := make([]float64, k)
+	for i := range centres {
+		centres[i] = h.edge(0) + (float64(i)+0.5)*h.binWidth*float64(len(h.counts))/float64(k)
+	}
+	for iteration := 0; iteration < 100; iteration++ {
+		sums := make([]float64, k)
+		counts := make([]float64, k)
+		for bin, c := range h.counts {
+			if c == 0 {
+				continue
+			}
+			v := h.centre(bin)
+			nearest := 0
+			for i := range centres {
+				if math.Abs(v-centres[i]) < math.Abs(v-centres[nearest]) {
+					nearest = i
+				}
+			}
+			sums[nearest] += v * c
+			counts[nearest] += c
+		}
+		moved := false
+		for i := range centres {
+			if counts[i] > 0 {
+				if c := sums[i] / counts[i]; c != centres[i] {
+					centres[i] = c
+					moved = true
+				}
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+	slices.Sort(centres)
+	thresholds := make([]float64, n)
+	for i := range thresholds {
+		thresholds[i] = (centres[i] + centres[i+1]) / 2
+	}
+	return thresholds
+}
@@ -139,6 +139,43 @@ func (c ContourT) Compress() ContourT {
 	return cc
 }
 
+// A contour is closed if it ends where it started.
+func (c ContourT) IsClosed() bool {
+	return len(c) > 2 && c[0].Equal(c[len(c)-1])
+}
+
+func (c ContourT) Length() float64 {
+	length := 0.0
+	for i := 1; i < len(c); i++ {
+		length += c[i-1].Distance(c[i])
+	}
+	return length
+}
+
+// Area enclosed by a closed contour, by the shoelace formula.
+// It's positive if the contour goes clockwise on the page (with y going down),
+// and negative if it goes anticlockwise.
+func (c ContourT) SignedArea() float64 {
+	area := 0.0
+	for i := 1; i < len(c); i++ {
+		area += c[i-1].x*c[i].y - c[i].x*c[i-1].y
+	}
+	return area / 2
+}
+
+// Whether p is inside a closed contour: a line from p to the right
+// crosses the contour an odd number of times.
+func (c ContourT) Contains(p Point64T) bool {
+	inside := false
+	for i := 1; i < len(c); i++ {
+		a, b := c[i-1], c[i]
+		if (a.y > p.y) != (b.y > p.y) && p.x < a.x+(p.y-a.y)*(b.x-a.x)/(b.y-a.y) {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
 type ContourS []ContourT
 
 func (cs ContourS) String() string {
@@ -170,25 +207,153 @@ var paperSizes = map[string]RectangleT{
 
 // Options and derived things
 type OptsT struct {
-	infile     string
-	width      int
-	height     int
-	thresholds []int
-	tcount     int
-	margin     float64
-	paper      string
-	paperSize  RectangleT
-	image      bool
-	clip       bool
-	debug      bool
-	linewidth  float64
-	framewidth float64
-	colours    string // two hex colours, e.g. "0033ff,0c4088"
+	infile         string
+	width          int
+	height         int
+	thresholds     []float64
+	tcount         int
+	margin         float64
+	paper          string
+	paperSize      RectangleT
+	image          bool
+	clip           bool
+	debug          bool
+	linewidth      float64
+	framewidth     float64
+	colours        string // two hex colours, e.g. "0033ff,0c4088"
+	inputFormat    string
+	nodata         float64
+	nodataSet      bool
+	mask           string
+	alphaCutoff    float64
+	channel        string
+	invert         bool
+	interval       float64
+	base           float64
+	tmin           float64
+	tmax           float64
+	tminSet        bool
+	tmaxSet        bool
+	valueRange     []float64 // two values: what the lowest and highest become
+	autoThresholds string    // method for choosing thresholds from the histogram
+	indexEvery     int       // every Nth contour is an index contour
+	indexLinewidth float64
+	indexColour    string
+	styles         string         // stroke styles for the layers, as given
+	stylesFile     string         // file of stroke styles
+	strokeStyles   []StrokeStyleT // parsed from styles or stylesFile
+	format         string         // output format: svg, gcode, ...
+	gcodePen       string         // z or servo
+	gcodeOrigin    string
+	penUp          float64 // Z height, or servo setting
+	penDown        float64
+	penDelay       float64  // seconds
+	penChange      bool     // pause between layers
+	feedRate       float64  // mm/minute
+	travelRate     float64  // mm/minute; 0 for rapid moves
+	pens           []int    // HPGL pen for each layer, in turn
+	geo            *GeoRefT // from the input, if it has one
+	preview        string   // PNG file
+	previewDPI     float64
+	clipGeometry   bool    // leave out the clip path, which the clipped contours don't need
+	clipInset      float64 // mm
+	join           bool    // join pieces of contours where they meet
+	joinFrame      bool    // and along the edge of the image
+	order          bool    // put paths in order to cut down pen-up travel
+	keepDirection  bool    // when ordering, don't reverse open paths
+	smooth         string  // chaikin or curve; "" for none
+	simplify       float64 // tolerance, in mm; 0 for none
+	simplifyMethod string  // rdp or visvalingam
+	minLength      SizeT   // contours shorter than this are left out
+	minArea        SizeT   // and those enclosing less than this
+	maxCount       int     // and all but this many of the longest; 0 for all
+	report         string  // file for statistics, or "-" for standard output
 }
 
 func (o OptsT) String() string {
-	return fmt.Sprintf("infile: \"%s\", width: %d, height: %d, thresholds: %v, tcount: %d, margin: %.2f, paper: \"%s\", paperSize: {%.2f, %.2f}, image: %t, clip: %t, debug: %t, linewidth: %.2f, framewidth: %.2f, colours: \"%s\"", o.infile, o.width, o.height, o.thresholds, o.tcount, o.margin, o.paper, o.paperSize.width, o.paperSize.height, o.image, o.clip, o.debug, o.linewidth, o.framewidth, o.colours)
+	s := fmt.Sprintf("infile: \"%s\", width: %d, height: %d, thresholds: %v, tcount: %d, margin: %.2f, paper: \"%s\", paperSize: {%.2f, %.2f}, image: %t, clip: %t, debug: %t, linewidth: %.2f, framewidth: %.2f, colours: \"%s\"", o.infile, o.width, o.height, o.thresholds, o.tcount, o.margin, o.paper, o.paperSize.width, o.paperSize.height, o.image, o.clip, o.debug, o.linewidth, o.framewidth, o.colours)
+	// Newer options are only listed if they've been used
+	if o.inputFormat != "" && o.inputFormat != "auto" {
+		s += fmt.Sprintf(", inputFormat: \"%s\"", o.inputFormat)
+	}
+	if o.nodataSet {
+		s += fmt.Sprintf(", nodata: %g", o.nodata)
+	}
+	if o.mask != "" {
+		s += fmt.Sprintf(", mask: \"%s\"", o.mask)
+	}
+	if o.alphaCutoff != 0 && o.alphaCutoff != 0.5 {
+		s += fmt.Sprintf(", alphaCutoff: %g", o.alphaCutoff)
+	}
+	if o.channel != "" && o.channel != defaultChannel.name {
+		s += fmt.Sprintf(", channel: \"%s\"", o.channel)
+	}
+	if o.invert {
+		s += ", invert: true"
+	}
+	if o.interval > 0 {
+		s += fmt.Sprintf(", interval: %g, base: %g", o.interval, o.base)
+	}
+	if o.tminSet {
+		s += fmt.Sprintf(", tmin: %g", o.tmin)
+	}
+	if o.tmaxSet {
+		s += fmt.Sprintf(", tmax: %g", o.tmax)
+	}
+	if len(o.valueRange) == 2 {
+		s += fmt.Sprintf(", valueRange: %v", o.valueRange)
+	}
+	if o.autoThresholds != "" {
+		s += fmt.Sprintf(", autoThresholds: \"%s\"", o.autoThresholds)
+	}
+	if o.styles != "" {
+		s += fmt.Sprintf(", styles: \"%s\"", o.styles)
+	}
+	if o.stylesFile != "" {
+		s += fmt.Sprintf(", stylesFile: \"%s\"", o.stylesFile)
+	}
+	if o.format != "" && o.format != "svg" {
+		s += fmt.Sprintf(", format: \"%s\"", o.format)
+	}
+	if o.format == "gcode" {
+		s += fmt.Sprintf(", gcodePen: \"%s\", penUp: %g, penDown: %g, penDelay: %g, penChange: %t, feedRate: %g, travelRate: %g, gcodeOrigin: \"%s\"",
+			o.gcodePen, o.penUp, o.penDown, o.penDelay, o.penChange, o.feedRate, o.travelRate, o.gcodeOrigin)
+	}
+	if o.format == "hpgl" {
+		s += fmt.Sprintf(", pens: %v", o.pens)
+	}
+	if o.report != "" {
+		s += fmt.Sprintf(", report: \"%s\"", o.report)
+	}
+	if o.preview != "" {
+		s += fmt.Sprintf(", preview: \"%s\", previewDPI: %g", o.preview, o.previewDPI)
+	}
+	if o.clipGeometry {
+		s += ", clipGeometry: true"
+	}
+	if o.clipInset != 0 {
+		s += fmt.Sprintf(", clipInset: %g", o.clipInset)
+	}
+	if o.join {
+		s += fmt.Sprintf(", join: true, joinFrame: %t", o.joinFrame)
+	}
+	if filtering(o) {
+		s += fmt.Sprintf(", minLength: %v, minArea: %v, maxCount: %d", o.minLength, o.minArea, o.maxCount)
+	}
+	if o.simplify > 0 {
+		s += fmt.Sprintf(", simplify: %g, simplifyMethod: \"%s\"", o.simplify, o.simplifyMethod)
+	}
+	if o.smooth != "" {
+		s += fmt.Sprintf(", smooth: \"%s\"", o.smooth)
+	}
+	if o.order {
+		s += fmt.Sprintf(", order: true, keepDirection: %t", o.keepDirection)
+	}
+	if o.indexEvery > 0 {
+		s += fmt.Sprintf(", indexEvery: %d, indexLinewidth: %.2f, indexColour: \"%s\"", o.indexEvery, o.indexLinewidth, o.indexColour)
+	}
+	return s
 }
 
-const white = 0xff
-const black = 0x00
+// The value of pixels off the edge of the image: higher than any threshold
+var offImageValue = math.Inf(1)
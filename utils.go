@@ -26,23 +26,28 @@ import (
 	"strings"
 )
 
-// loadImage loads the specified image from disk. Supported file types are png and jpg
-func loadImage(path string) (*image.NRGBA, int, int, error) {
+// decodeImage loads the specified image from disk. Supported file types are png, jpg, and gif
+func decodeImage(path string) (image.Image, error) {
 	srcReader, err := os.Open(path)
 	if err != nil {
-		return nil, 0, 0, fmt.Errorf("failed to read input image: %s, %s", path, err)
+		return nil, fmt.Errorf("failed to read input image: %s, %s", path, err)
 	}
 	defer srcReader.Close()
 	img, _, err := image.Decode(srcReader)
 	if err != nil {
-		return nil, 0, 0, fmt.Errorf("failed to decode image on load: %s, %s", path, err)
+		return nil, fmt.Errorf("failed to decode image on load: %s, %s", path, err)
 	}
-	// Make sure image is NRGBA, with bounds starting at 0,0
-	inputImage := ImageToNRGBA(img)
-	bounds := inputImage.Bounds()
-	width := bounds.Max.X - bounds.Min.X
-	height := bounds.Max.Y - bounds.Min.Y
-	return inputImage, width, height, nil
+	return img, nil
+}
+
+// loadImage loads the specified image from disk as a height map.
+func loadImage(path string) (*HeightMapT, int, int, error) {
+	img, err := decodeImage(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	hm := imageToHeightMap(img, defaultChannel)
+	return hm, hm.width, hm.height, nil
 }
 
 // ImgToNRGBA converts any image type to *image.NRGBA with min-point at (0, 0).
@@ -116,10 +121,10 @@ func degrees(radians float64) float64 {
 	return radians * 180 / math.Pi
 }
 
-func intsToString(ints []int) string {
-	strs := make([]string, len(ints))
-	for i, v := range ints {
-		strs[i] = strconv.Itoa(v)
+func floatsToString(floats []float64) string {
+	strs := make([]string, len(floats))
+	for i, v := range floats {
+		strs[i] = strconv.FormatFloat(v, 'g', -1, 64)
 	}
 	return strings.Join(strs, ",")
 }
@@ -152,17 +157,6 @@ func limitInt(n, low, high int) int {
 	return n
 }
 
-// Return a slice of integers evenly spaced from 1 to 255.
-// Assumes n is within the range 1 to 255
-func evenThresholds(n int) []int {
-	step := 256.0 / float64(n+1)
-	thresholds := make([]int, n)
-	for i := range n {
-		thresholds[i] = int(math.Round(step * float64((i + 1))))
-	}
-	return thresholds
-}
-
 func almostEqual(a, b float64, epsilon float64) bool {
 	return math.Abs(a-b) <= epsilon
 }